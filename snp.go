@@ -36,7 +36,7 @@
 *             for simple, then I only need simple and block (for block level   *
 *             content in cells, e.g. lists and images.                         *
 *                                                                              *
-*          5. A format for list of images with text comments (hard)            *
+*          5. A format for list of images with text comments (Done: gallery)   *
 *                                                                              *
 *          6. Code cleanup.  Move code to functions, even if used only once.   *
 *             Might be a higher priority, and implementing new functionality   *
@@ -56,22 +56,48 @@
 *   debug        convenience function to print debugging messages	       *
 *   info         thinnest possible wrapper around fmt.Println		       *
 *   error        report error messages with string prefix		       *
+*   warn         report warnings                                               *
 *   abort        abort processing and end program gracefully      	       *
 *   checkArgs    verifies sanity of arguments				       *
 *   readInput    reads a file into a []string				       *
+*   parseDiv     reads the fence of an exercise or solution block              *
+*   exerciseDiv  opens or closes an exercise, or collects a solution           *
+*   writeSolutions writes the solutions in a file of their own                 *
+*   clozeMD      turns {{blanks}} into underlining for the Markdown            *
+*   writeHandout writes the notes with blanks for the answers, and a key       *
+*   audienceLines keeps only the lines tagged for the audience being built     *
+*   buildAudiences runs snp again for each of several audiences                *
 *   writeOutput  writes a string to a file				       *
 *   push         convenience function to push a string onto a []string stack   *
 *   pop          convenience function to pop a string from a []string stack    *
 *   processLines parses the SN markup "language" and converts to LaTeX	       *
 *   addGraphics  add an \includegraphics LaTeX command			       *
+*   parseGraphics reads a g line into a Figure (parseImageLine reads ![]())    *
+*   emitFigure   writes a graphic or numbered figure to every output           *
+*   imageFor     picks or converts the best image format for an output         *
+*   checkBitmap  warns about low-resolution bitmaps and shrinks big ones       *
+*   parseEquation reads display math, which emitEquation numbers and writes    *
+*   parseCode    reads fenced code, for listings/minted and the HTML highlighter*
+*   runCode      runs a code block (or reads the cache) to show its output     *
+*   renderDiagram draws a diagram block (or finds it in the cache)             *
+*   diagramFigure reads a diagram block's caption and attributes               *
+*   emitDiagram  shows a diagram block as a figure                             *
+*   parseGallery reads a gallery of images with commentary (emitGallery)       *
+*   collectLabels numbers figures etc. so references can be resolved           *
+*   sectionTitle splits a section's title from its {#label} and frame style    *
+*   sectionSlug  makes a label from a title, as Pandoc makes identifiers       *
+*   resolveRefs  turns @fig:label references into TeX or Markdown links        *
 *   addItem      add an \item						       *
 *   addTeXlines  writes LaTeX to notes, slides or both files		       *
+*   addNotesSlides writes different LaTeX to the notes and slides              *
+*   addMDlines   writes to the Markdown file only                              *
 *   pushEnv      push a LaTeX environment onto a stack			       *
 *   popEnv       pop a LaTeX environment from a stack			       *
 *   popEnvs      pop all the environments from the stack		       *
 *   writeCommon  write the LaTeX code common to both notes and slides	       *
 *   writeNotes   write the LaTeX code for the notes			       *
 *   writeSlides  write the LaTeX code for the slides			       *
+*   openingFrames the title and outline frames that open the slides            *
 *   runTeX       run external programs on the generated files		       *
 *   runProg      runs a program with arguments on a file                       *
 *   baseName     returns a filename minus the extension                        *
@@ -79,17 +105,39 @@
 *   fileExists   return whether a file exists, and if it does, its size	       *
 *   strElide     return the first n characters of a string		       *
 *   readConf     read external configuration files and store in Options struct *
+*   readLocalConf reads the course's and lecture's own configuration files     *
 *   substr       return the substring between two delimiters, optionally       *
 *                including the delimiters                                      *
+*   tc           the old two-column layout, kept for old source files          *
+*   parseColumns checks the parameters of a multi-column layout                *
+*   beginColumns starts a multi-column layout (also splitColumns, endColumns)  *
+*   parseTable   parses any of Pandoc's four table formats into a Table        *
+*   emitTable    writes a Table as TeX, and as Markdown or HTML                *
+*   loadCSV      loads a CSV or TSV data file as a Table                       *
+*   parseBib     reads BibTeX entries, so checkCitations can check cited keys  *
+*   citations    turns Pandoc citations into TeX, or formats them for Markdown *
+*   referencesMD formats the list of references for the Markdown notes         *
+*   parseFootnote reads a footnote's definition; footnotes go inline           *
+*   slideFootnotes puts footnotes at the foot of frames, or drops them         *
+*   escapeTeX    escapes prose for TeX, leaving math, code, URLs and raw TeX be*
 *									       *
 *******************************************************************************/
 
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/dustin/go-humanize"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"math"
@@ -100,6 +148,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 	//	"github.com/mvdan/xurls"
 )
 
@@ -173,12 +223,52 @@ type Options struct {
 	Tab               int
 	Indent            int
 	hasCitations      bool
+	bibFiles          []string
+	csl               string
+	bibBackend        string // biblatex or natbib
+	citeStyle         string // authoryear or numeric
+	bibStyle          string // The BibTeX style, for natbib
+	slideCiteFooter   bool
+	slideFootnotes    string    // frame or notes
+	headingFrames     [2]string // What (sub)subsections are in the slides
+	solutions         string    // appendix, separate or none
+	htmlMath          string    // mathml or katex
+	codePackage       string    // listings or minted
+	execTimeout       int       // Seconds that runnable code may take
+	plantUML          string    // The PlantUML jar
+	katex             string    // Where the KaTeX files are
+	slideReferences   bool
+	slideTableRows    int
+	longTableRows     int
+	listOfFigures     bool
+	notesTOC          bool
+	clozeKey          bool
+	audienceTags      map[string][]string
+	slideTitle        bool
+	slideOutline      bool
+	sectionOutlines   bool
+	cacheDir          string
+	notesTextWidth    float64
+	slidesTextWidth   float64
+	minDPI            int
+	maxDPI            int
+	downsample        bool
+	imageBudget       int
 	bold              string
 	italic            string
 }
 
 var o Options
 
+// A multi-column layout. Widths are fractions of the line width, and Align
+// is one of Beamer's column alignments (t, c or b).
+type Columns struct {
+	Widths []float64
+	Align  string
+	Col    int
+	Open   bool
+}
+
 var slidesCount int
 var lines []string
 var notesTeXlines []string
@@ -191,6 +281,8 @@ var totalSize uint64
 var whichToKeep string
 var printSizes bool
 var run_TeX bool
+var profile string
+var audience string // The audience being built for, if any
 var del_TeX bool
 var leave_alone bool
 var fileSizes map[string]uint64
@@ -199,14 +291,24 @@ var confLocation string
 var confFile string
 var SlidesOnly bool
 var NotesOnly bool
-var col_2_w, mp_h string
 var line_number int
 var indent_level int
 var list_type string
 var image_used bool
 var in_table bool
-var table_type string
 var pure_MD bool
+var md_skip bool
+var frame_title, frame_style string
+var labels map[string]Label
+var footnotes = map[string]string{}  // Footnote texts, by id
+var sectionLabels = map[int]string{} // Section labels, by line
+var section_label string             // The label of the section being opened
+var section_level int                // 1 for a section, 2 for a subsection...
+var figureCount int
+var placedLOF bool // Whether [lof] has placed the list of figures
+var equationCount int
+var collecting bool // True during the pre-pass for labels
+var columns Columns
 
 //var TeXPreambleCommon
 
@@ -218,8 +320,26 @@ func main() {
 		abort("Failed to read config file (" + confFile + ")")
 	}
 	filename, _ := checkArgs(&o)
-	lines = readInput(filename)
+	readLocalConf(filename)
+	audiences := []string{}
+	for _, a := range strings.Split(audience, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			audiences = append(audiences, a)
+		}
+	}
+	if len(audiences) > 1 {
+		buildAudiences(filename, audiences)
+		return
+	}
+	audience = strings.Join(audiences, "")
+	lines = audienceLines(readInput(filename))
+	collectLabels(lines)
+	loadManifest()
 	processLines(lines)
+	saveManifest()
+	if listUnused {
+		reportUnused()
+	}
 
 	n := make(chan bool)
 	s := make(chan bool)
@@ -319,6 +439,7 @@ func init() {
 	printSizes = false
 	run_TeX = true
 	fileSizes = make(map[string]uint64)
+	labels = make(map[string]Label)
 	pl = make(PairList, maxIncludes) // List of included files and sizes
 	SlidesOnly = false
 	NotesOnly = false
@@ -342,6 +463,10 @@ func init() {
 	flag.BoolVar(&printSizes, "s", false, "Print size of included files")
 	flag.BoolVar(&run_TeX, "t", true, "Run TeX")
 	flag.BoolVar(&del_TeX, "k", false, "Do not delete TeX files after processing them")
+	flag.StringVar(&profile, "p", "print", "Build profile: 'print', or 'web' to recompress bitmaps")
+	flag.BoolVar(&listUnused, "u", false, "List bibliography entries that are never cited")
+	flag.BoolVar(&noExec, "no-exec", false, "Do not run code blocks (use cached output only)")
+	flag.StringVar(&audience, "a", "", "Audiences to build for, e.g. 'instructor,student'")
 }
 
 func term(s string, style int, fg int, bg int) string {
@@ -379,6 +504,11 @@ func error(s string, e string) {
 		term("Error", termNOOP, termWhite, termBlue), s, e))
 }
 
+func warn(s string) {
+	info(fmt.Sprintf("%s: %s",
+		term("Warning", termNOOP, termBlack, termYellow), s))
+}
+
 func abort(s string) {
 	info("\033[31mFatal error: \033[m: " + s)
 	os.Exit(1)
@@ -420,6 +550,9 @@ func checkArgs(o *Options) (string, uint64) {
 	if !found {
 		abort("Specified file (" + filename + ") not found")
 	}
+	if profile != "print" && profile != "web" {
+		abort("Unknown build profile '" + profile + "': use 'print' or 'web'")
+	}
 
 	if Debug > 0 {
 		debug("Debugging output on")
@@ -486,9 +619,67 @@ func pop(stack []string) {
 func processLines(lines []string) {
 	// Read each line and search for switches
 	// FIXME: move MD processing to a separate function
+	skip := 0 // Lines already consumed by a multi-line construct
 	for i := range lines {
-		line_number++
+		line_number = sourceLine(i)
+		if skip > 0 {
+			skip--
+			continue
+		}
 		line := lines[i]
+		md_skip = false
+
+		// Tables span several lines, and images on a line of their
+		// own are figures, so they are recognised before anything
+		// else gets at the line
+		if !leave_alone {
+			if _, _, n := parseFootnote(lines, i); n > 0 {
+				// Only the Markdown needs the definition: the TeX gets
+				// the text where the note is referred to
+				def := make([]string, n)
+				for k, l := range lines[i : i+n] {
+					def[k] = citations(resolveRefs(clozeMD(l), true), true)
+				}
+				addMDlines(strings.Join(def, "\n") + "\n")
+				skip = n - 1
+				continue
+			}
+			if kind, title, label, ok := parseDiv(line); ok {
+				if isExerciseDiv(kind) {
+					md_line = line
+					exerciseDiv(kind, title, label)
+					continue
+				}
+				pandocDiv(kind)
+			}
+			if f, ok := parseImageLine(line); ok {
+				md_line = line
+				emitFigure(f)
+				continue
+			}
+			if c, n := parseCode(lines, i); n > 0 {
+				md_line = line
+				if _, ok := diagramLangs[c.Lang]; ok {
+					emitDiagram(c)
+				} else {
+					emitCode(c)
+				}
+				skip = n - 1
+				continue
+			}
+			if e, n := parseEquation(lines, i); n > 0 {
+				md_line = line
+				emitEquation(e)
+				skip = n - 1
+				continue
+			}
+			if t, n := parseTable(lines, i); n > 0 {
+				md_line = line
+				emitTable(t)
+				skip = n - 1
+				continue
+			}
+		}
 
 		// detect TeX markup
 		re_slash := regexp.MustCompile(`\\\w+`)
@@ -507,6 +698,10 @@ func processLines(lines []string) {
 		// Save the MD input, then make the line safe for TeX, and translate
 		// some character sequences to TeX.
 		md_line = line
+		section_label = sectionLabels[i]
+		if section_label != "" {
+			line = re_sec_id.ReplaceAllString(line, "")
+		}
 		line = process_md(line)
 
 		// Split the line at the first space
@@ -560,10 +755,24 @@ func processLines(lines []string) {
 				abort("The source file indicates that the year is " + sourceYear + " but the system says that it's " + thisYear + "!\n")
 			}
 		case "s", "#":
-			slidesCount++
+			section_level = 1
+			if key == "#" {
+				section_level = len(keys[0]) - len(strings.TrimLeft(keys[0], "#"))
+			}
 			if Debug > 1 {
 				fmt.Println("Section: " + v)
 			}
+			if section_label != "" {
+				// The heading in the Markdown gets the label as its
+				// identifier, so that references can link to it (and
+				// Pandoc wants a blank line before it)
+				title, _ := sectionTitle(strings.SplitN(md_line, " ", 2)[1])
+				level := "#"
+				if key == "#" {
+					level = keys[0]
+				}
+				addMDlines("\n" + citations(resolveRefs(level+" "+title+" {#"+section_label+"}", true), true) + "\n")
+			}
 			popEnvs()
 			pushEnv("section", v)
 		case "[bv]":
@@ -571,6 +780,7 @@ func processLines(lines []string) {
 		case "[ev]":
 			leave_alone = false
 		case "[soh]":
+			section_level = 1
 			SlidesOnly = true
 			pushEnv("section", v)
 			SlidesOnly = false
@@ -585,7 +795,38 @@ func processLines(lines []string) {
 		case "e":
 			popEnv(" % manually closed")
 		case "g":
-			addGraphics(v)
+			// Use the source line, so the caption reaches the
+			// Markdown file untouched
+			addGraphics(strings.TrimSpace(strings.TrimPrefix(md_line, "g")))
+		case "gallery":
+			g, n := parseGallery(lines, i)
+			emitGallery(g)
+			skip = n - 1
+		case "[lof]":
+			NotesOnly = true
+			md_skip = true
+			addTeXlines("\\listoffigures\n")
+			NotesOnly = false
+			placedLOF = true
+		case "csv":
+			// Use the source line: the options mustn't be made TeX-safe
+			t := loadCSV(strings.TrimSpace(strings.TrimPrefix(md_line, "csv")))
+			// A caption may follow the directive, as it may follow a table
+			j := i + 1
+			if j < len(lines) && blank(lines[j]) {
+				j++
+			}
+			if j < len(lines) {
+				if c, ok := tableCaption(lines[j], true); ok {
+					c, attrs := splitAttrs(c)
+					t.Caption = c
+					if attrs["split"] != "" {
+						t.Split = splitOption(attrs["split"])
+					}
+					skip = j - i
+				}
+			}
+			emitTable(t)
 		case "p":
 			tmp := NotesOnly
 			popEnvs()
@@ -596,7 +837,8 @@ func processLines(lines []string) {
 			pushEnv("quote", v)
 
 		case "t":
-			pushEnv("tabular", v)
+			// Use the source line: the column spec is TeX
+			pushEnv("tabular", strings.TrimSpace(strings.TrimPrefix(md_line, "t")))
 		case "[slidesonly]", "[so]":
 			SlidesOnly = true
 			addTeXlines(v + "\n")
@@ -641,32 +883,25 @@ func processLines(lines []string) {
 
 		case "[preamble]":
 			o.TeXPreambleCommon += "\n" + v
+		case "cb":
+			beginColumns(strings.TrimSpace(strings.TrimPrefix(md_line, "cb")))
+		case "cs":
+			splitColumns()
+		case "ce":
+			endColumns()
 		case "tcb":
-			tc("begin", v)
-			if Debug > -1 {
-				info("Found TeX-specific SN code (tc)")
-			}
+			tc("begin", strings.TrimSpace(strings.TrimPrefix(md_line, "tcb")))
 		case "tce":
 			tc("end", "")
 		case "tcs":
 			tc("split", "")
 		case ":": // description item. The data is in the previous line though!
-			term_label := smart_punc(lines[i-1])
+			term_label := escapeTeX(lines[i-1])
 			notesTeXlines[len(notesTeXlines)-1] = ""
 			slidesTeXlines[len(slidesTeXlines)-1] = ""
 			item := "[" + term_label + "] " + v
 			addItem("d", item)
 		case "%":
-			if in_table && regexp.MustCompile(`-{2,}`).FindStringIndex(md_line) != nil {
-				debug("appending: " + md_line + "to markdownLines")
-				//reconstruct the bogus colspec
-				cols := regexp.MustCompile(`\|`).FindAllStringSubmatch(md_line, -1)
-				cols_n := len(cols) + 1
-				//colspec := makeColspec(cols)
-				//debug("colspec: " + colspec)
-				info("Found " + strconv.Itoa(cols_n) + " columns in a pipe table")
-				markdownLines = append(markdownLines, md_line+"\n")
-			}
 		case "#%":
 		default: // could be blank or indented
 			if line_number == 5002 {
@@ -674,13 +909,6 @@ func processLines(lines []string) {
 				info(strconv.Itoa(line_number) + " TeX line     : " + line)
 			}
 
-			if in_table && line != "" {
-				if table_type == "simple" {
-					line = regexp.MustCompile(`\s{2,}`).ReplaceAllString(line, " & ") + "\\\\ "
-				} else {
-					line = regexp.MustCompile(`\|`).ReplaceAllString(line, " & ") + "\\\\ "
-				}
-			}
 			re_4 := regexp.MustCompile(`^\s{4,}(\-|1\.)`) // at least four spaces at the start of a line, followed by '-' or '1.'
 			if re_4.FindStringIndex(line) != nil {
 				addItem("", line)
@@ -696,1031 +924,6002 @@ func processLines(lines []string) {
 			}
 		}
 	}
+	if columns.Open {
+		error("Columns opened with cb were never closed", "missing ce")
+		endColumns()
+	}
+	closeDivs()
 }
 
 /******************************************************************************
  This function handles the inclusion of graphics.  It needs to parse
  arguments given in the source file, which makes it a bit complex ...
+ The source looks like this:
 
- FIXME: allow arbitrary arguments to be passed to \includegraphics
- Currently assumes that there are ONLY one or two integers between the
- delimiters, and the first two are scaling factors. Does no error
- checking.
+     g [notesScale,slidesScale,args] file | Caption {#fig:label alt="..."}
 
- FIXME: BUG: does not pass different scaling factors to notes and
- slides files!
+ Everything but the file is optional.  With a caption, the graphic becomes
+ a numbered figure, which can be referred to as @fig:label.  The alt text
+ (which defaults to the caption) is kept in the PDF and HTML for screen
+ readers.  The attributes are the same as for Markdown images: see
+ imageAttrs.
 
 ******************************************************************************/
-func addGraphics(filename string) string {
-	f := strings.TrimLeft(filename, "] ")
 
-	notesScale := ""
-	slidesScale := ""
-	args := ""
+// How a graphic is sized and placed in the notes or on the slides.
+type Placement struct {
+	Scale string
+	Args  []string // Other \includegraphics arguments, e.g. width=5cm
+	Align string   // "", "left", "center" or "right"
+}
 
-	scaling := substr(filename, "[", "]", false)
-	f = substr(filename, "]", "", false)
-	found, size := fileExists(f, "graphics")
-	if !found {
-		abort(f + " does not exist")
-	} else {
-		fileSizes[f] = size
-		totalSize += size
-	}
+// A graphic, which is a numbered figure if it has a caption.
+type Figure struct {
+	Path    string
+	Caption string
+	Alt     string
+	Label   string
+	Number  int
+	Notes   Placement
+	Slides  Placement
+	Width   string // The size in the HTML, as given in the source
+	Height  string
+}
 
-	// Write the LaTeX code for the appropriate file(s)
-	if scaling == "" { // No scaling supplied
-		addTeXlines("\\includegraphics{" + f + "}\n")
-	} else {
-		scales := strings.Split(scaling, ",")
+// Reads a g line, e.g. "g [0.5,0.3,angle=90] path | Caption {#fig:label}".
+// The scales are for the notes and slides; any other arguments in the
+// brackets are image attributes, like those in braces (see imageAttrs).
+func parseGraphics(v string) Figure {
+	f := Figure{}
+	extra := map[string]string{}
+	spec := strings.TrimSpace(v)
+	if strings.HasPrefix(spec, "[") && strings.Contains(spec, "]") {
+		scales := strings.Split(substr(spec, "[", "]", false), ",")
+		spec = substr(spec, "]", "", false)
 
 		if len(scales) == 1 && scales[0] != "" {
-			notesScale = scales[0]
-			slidesScale = scales[0]
+			f.Notes.Scale = scales[0]
+			f.Slides.Scale = scales[0]
 		}
-		if len(scales) == 2 {
-			slidesScale = scales[1]
-			notesScale = scales[0]
+		if len(scales) >= 2 {
+			f.Notes.Scale = strings.TrimSpace(scales[0])
+			f.Slides.Scale = strings.TrimSpace(scales[1])
 		}
-
-		if len(scales) > 2 { // Pass arbitrary args to \includegraphics
-			args = scales[2]
+		for _, a := range scales[int(math.Min(2, float64(len(scales)))):] {
+			k, v, _ := strings.Cut(strings.TrimSpace(a), "=")
+			extra[strings.TrimSpace(k)] = strings.TrimSpace(v)
 		}
-		//info( "Scales for graphics file '"+ filename + "' are: " + notesScale + "(Notes); " + slidesScale + " (Slides)" )
-		if SlidesOnly == false && NotesOnly == false {
-			NotesOnly = true
-			addTeXlines("\\includegraphics[scale=" +
-				notesScale + "," + args + "]{" + f + "}\n")
-			NotesOnly = false
+	}
 
-			SlidesOnly = true
-			addTeXlines("\\includegraphics[scale=" +
-				slidesScale + "," + args + "]{" + f + "}\n")
-			SlidesOnly = false
-		} else if NotesOnly {
-			addTeXlines("\\includegraphics[scale=" +
-				notesScale + "," + args + "]{" + f + "}\n")
-		} else if SlidesOnly {
-			addTeXlines("\\includegraphics[scale=" +
-				slidesScale + "," + args + "]{" + f + "}\n")
+	caption := ""
+	if k := strings.Index(spec, " | "); k >= 0 {
+		caption = spec[k+3:]
+		spec = spec[:k]
+	}
+	f.Path = strings.TrimSpace(spec)
+	caption, attrs := splitAttrs(caption)
+	f.Caption = strings.TrimSpace(caption)
+	for k, v := range extra {
+		if _, ok := attrs[k]; !ok {
+			attrs[k] = v
 		}
 	}
-	return slidesScale
+	imageAttrs(&f, attrs)
+	return f
 }
 
-func addItem(key string, item string) {
-	// This function adds an item to a list. It implements three
-	// types: itemize, enumerate and description.
-	// FIXME: It seems unreasonably long and complex. Can I factor
-	// out the markdown code, or make into (one-use) functions?
-	e := ""
-	inList := false
-	re_k := regexp.MustCompile(`^\s+\-|(\d\.)`) // First non-space item markers
+var re_image_line = regexp.MustCompile(`^\s*!\[([^\]]*)\]\(([^)\s]+)(\s+"[^"]*")?\)\s*(\{[^{}]*\})?\s*$`)
+
+// Reads an image that stands alone on a line, e.g.
+//
+//     ![Caption](path){#fig:label notes-width=50% slides-width=80%}
+//
+// As in Pandoc, the alt text is the caption, unless there is an alt
+// attribute.
+func parseImageLine(line string) (Figure, bool) {
+	m := re_image_line.FindStringSubmatch(line)
+	if m == nil {
+		return Figure{}, false
+	}
+	_, attrs := splitAttrs(m[4])
+	f := Figure{Path: m[2], Caption: strings.TrimSpace(m[1])}
+	imageAttrs(&f, attrs)
+	return f, true
+}
 
-	re_b := regexp.MustCompile(`^\[\s([^\s]+?)\s\]\s+`) // [] Brackets
+// The image attributes that make sense in TeX and HTML.  Any of them may
+// be prefixed with notes- or slides- to apply to just that output.
+var imageKeys = map[string]bool{"width": true, "height": true, "scale": true,
+	"angle": true, "align": true}
+
+// Reads image attributes into a figure, translating them for each output.
+// Keys \includegraphics doesn't know would break TeX, so they are dropped
+// with a warning.
+func imageAttrs(f *Figure, attrs map[string]string) {
+	f.Label = attrs["#"]
+	f.Alt = attrs["alt"]
+	if f.Alt == "" {
+		f.Alt = f.Caption
+	}
 
-	//re_n := regexp.MustCompile("^\\s*\\d+\\.")
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := attrs[k]
+		if k == "#" || k == "." || k == "alt" {
+			continue
+		}
+		outputs := []*Placement{&f.Notes, &f.Slides}
+		key := k
+		if strings.HasPrefix(k, "notes-") {
+			outputs, key = []*Placement{&f.Notes}, strings.TrimPrefix(k, "notes-")
+		} else if strings.HasPrefix(k, "slides-") {
+			outputs, key = []*Placement{&f.Slides}, strings.TrimPrefix(k, "slides-")
+		}
+		if collecting {
+			continue // Warnings come later, with the line number
+		}
+		if !imageKeys[key] {
+			warn("ignoring unknown image attribute '" + k + "' on line " +
+				strconv.Itoa(line_number))
+			continue
+		}
 
-	// Are we already in a list environment, even if it's not the current one?
-	for i := range envStack {
-		e = envStack[i]
-		if e == "itemize" || e == "enumerate" || e == "description" {
-			inList = true
-			break
+		arg := ""
+		switch key {
+		case "align":
+			v = strings.Replace(v, "centre", "center", 1)
+			if v != "left" && v != "center" && v != "right" {
+				warn("align must be left, center or right, not '" + v +
+					"' (line " + strconv.Itoa(line_number) + ")")
+				continue
+			}
+		case "scale", "angle":
+			if _, e := strconv.ParseFloat(v, 64); e != nil {
+				warn(k + " must be a number, not '" + v + "' (line " +
+					strconv.Itoa(line_number) + ")")
+				continue
+			}
+			arg = key + "=" + v
+		case "width", "height":
+			l := texLength(v, key)
+			if l == "" {
+				warn(k + " must be a length, not '" + v + "' (line " +
+					strconv.Itoa(line_number) + ")")
+				continue
+			}
+			arg = key + "=" + l
+			if k == "width" || (key == "width" && f.Width == "" && outputs[0] == &f.Notes) {
+				f.Width = v
+			}
+			if k == "height" || (key == "height" && f.Height == "" && outputs[0] == &f.Notes) {
+				f.Height = v
+			}
 		}
-	}
 
-	// Implement Markdown's list type based on list marker. FIXME:
-	// currently fails if two successive items have different list
-	// markers!
-	env := ""
-	// Key may be empty if the line starts with a space (i.e. is
-	// indented. If it is, make key the first non-space character.
+		for _, p := range outputs {
+			switch key {
+			case "align":
+				p.Align = v
+			case "scale":
+				p.Scale = v
+			default:
+				p.Args = append(p.Args, arg)
+			}
+		}
+	}
+}
 
-	if key == "" {
-		key = re_k.FindString(item)
-		//info("Empty key, replaced with '" + key + "'")
+// Converts a Pandoc length to TeX, or returns "" if it isn't a length.
+// Percentages become fractions of the line width (or text height), and
+// pixels are taken to be 1/96 inch, as in CSS.
+func texLength(l string, dim string) string {
+	m := regexp.MustCompile(`^([\d.]+)\s*(%|cm|mm|in|pt|bp|em|ex|px|\\linewidth|\\textwidth|\\textheight)?$`).FindStringSubmatch(strings.TrimSpace(l))
+	if m == nil {
+		return ""
 	}
-	switch key {
-	case "-":
-		// Search for custom marker
-		if re_b.FindAllString(item, -1) != nil {
-			image_used = true
-			addTeXlines("\\renewcommand\\labelitemi{" + re_b.FindString(item) + "}\n")
-			item = re_b.ReplaceAllString(item, "")
+	n, e := strconv.ParseFloat(m[1], 64)
+	if e != nil {
+		return ""
+	}
+	switch m[2] {
+	case "%":
+		if dim == "height" {
+			return strconv.FormatFloat(n/100, 'f', 3, 64) + "\\textheight"
 		}
-		env = "itemize"
-	case "n", "1.":
-		env = "enumerate"
-	case "d":
-		env = "description"
-	default:
-		env = "itemize"
+		return strconv.FormatFloat(n/100, 'f', 3, 64) + "\\linewidth"
+	case "px", "":
+		return strconv.FormatFloat(n/96, 'f', 3, 64) + "in"
 	}
+	return l
+}
 
-	// Implement Markdown's "four spaces rule" for auto-indentation.
-	this_indent_level := indent_level
-	re_4 := regexp.MustCompile(`^\s{4,}\-\s|^\s{4,}\d\.\s`) // At
-	// least four leading spaces followed by '- ' or '1. '
-	re_4 = regexp.MustCompile(`^\s{4,}(\-|1\.)`) // at least four spaces at the start of a line, followed by '-' or '1.'
-	pos := re_4.FindStringIndex(item)
+// Converts a length from the source to CSS.
+func htmlLength(l string) string {
+	m := regexp.MustCompile(`^([\d.]+)\s*\\(linewidth|textwidth|textheight)$`).FindStringSubmatch(l)
+	if m != nil {
+		n, _ := strconv.ParseFloat(m[1], 64)
+		return strconv.FormatFloat(n*100, 'f', 0, 64) + "%"
+	}
+	if regexp.MustCompile(`^[\d.]+$`).MatchString(l) {
+		return l + "px"
+	}
+	return l
+}
 
-	if pos != nil {
-		// There are AT LEAST 4 spaces. If there are 8 or
-		// more, indent level  is two, and so on.
-		// 		info("pos[1] is: " + strconv.Itoa(pos[0]) )
-		if pos[1] > 4 && pos[1] < 9 {
-			this_indent_level = 1
+func addGraphics(v string) {
+	emitFigure(parseGraphics(v))
+}
 
-		} else if pos[1] > 8 && pos[1] < 13 {
-			this_indent_level = 2
-		} // Only allows three-level lists
-		// Trim the list marker, except for description item
-		debug("Adding list item: " + item)
-		if env != "description" {
-			item = item[pos[1]:len(item)]
-		}
-		debug("Item is now: " + item)
+// Writes a graphic or figure to the notes, slides and Markdown file.
+func emitFigure(f Figure) {
+	md_skip = true
+	if f.Caption != "" {
+		figureCount++
+		f.Number = figureCount
+	}
 
+	// Each output gets the image format that suits it best
+	tex, html := f, f
+	tex.Path = imageFor(f.Path, "tex")
+	html.Path = imageFor(f.Path, "html")
+	if isBitmap(tex.Path) {
+		tex = checkBitmap(tex)
+	}
+	if _, size := fileExists(html.Path, ""); profile == "web" && isBitmap(html.Path) &&
+		size > uint64(o.imageBudget*1024) {
+		if b, ok := readBitmap(html.Path); ok {
+			if out, _, ok := shrinkBitmap(html.Path, b, b.Width, o.imageBudget*1024); ok {
+				html.Path = out
+			}
+		}
+	}
+	found, size := fileExists(tex.Path, "")
+	if !found {
+		abort(f.Path + " does not exist")
 	} else {
-		this_indent_level = 0
+		fileSizes[tex.Path] = size
+		totalSize += size
 	}
 
-	//info("Indent level is: " + strconv.Itoa(indent_level) )
-	// End Markdown-specific code
+	addMDlines(figureMD(html))
+	addNotesSlides(figureTeX(tex, tex.Notes), figureTeX(tex, tex.Slides))
+}
 
-	// OK, we know what type of environment the item belongs
-	// in. But is it the first item in a child environment?  Or
-	// resuming a parent environment?  And do we need to pop just
-	// one environment, or more?
-	if this_indent_level > indent_level {
-		//info("----> pushing " + env)
-		pushEnv(env, "  % auto-opened by auto-indenter")
-	} else if this_indent_level < indent_level {
-		// info("----> popping")
-		for this_indent_level < indent_level {
-			//info("This indent level: " + strconv.Itoa(this_indent_level) + "; previous indent level: " + strconv.Itoa(indent_level) )
-			popEnv(" % auto-closed from auto-indenter")
-			indent_level--
+// The arguments for \includegraphics.
+func graphicsArgs(p Placement) string {
+	a := []string{}
+	if p.Scale != "" {
+		a = append(a, "scale="+p.Scale)
+	}
+	for _, arg := range p.Args {
+		if arg != "" {
+			a = append(a, arg)
 		}
 	}
+	return strings.Join(a, ",")
+}
 
-	indent_level = this_indent_level
+func figureTeX(f Figure, p Placement) string {
+	g := "\\includegraphics"
+	if args := graphicsArgs(p); args != "" {
+		g += "[" + args + "]"
+	}
+	g += "{" + f.Path + "}"
+	if f.Path == "" {
+		g = "\\fbox{" + placeholder + "}" // A diagram that couldn't be drawn
+	} else if f.Alt != "" {
+		usePackage("accsupp")
+		g = "\\BeginAccSupp{method=pdfstringdef,Alt={" + escapeAlt(f.Alt) + "}}" + g + "\\EndAccSupp{}"
+	}
 
-	if inList {
-		pushEnv("item", item)
-	} else {
-		pushEnv(env, "  % auto-opened by list detector")
-		addItem(key, item) // recursion!
+	if f.Caption == "" {
+		env := map[string]string{"left": "flushleft", "center": "center",
+			"right": "flushright"}[p.Align]
+		if env != "" {
+			return "\\begin{" + env + "}\n" + g + "\n\\end{" + env + "}\n"
+		}
+		return g + "\n"
+	}
+
+	// The figure counter is set by hand, so that the notes, slides and
+	// HTML agree on the number even when a figure is in only one of them.
+	align := map[string]string{"": "\\centering", "left": "\\raggedright",
+		"center": "\\centering", "right": "\\raggedleft"}[p.Align]
+	s := "\\begin{figure}[htbp]\n" + align + "\n" +
+		"\\setcounter{figure}{" + strconv.Itoa(f.Number-1) + "}\n" +
+		g + "\n\\caption{" + process_md(f.Caption) + "}"
+	if f.Label != "" {
+		s += "\\label{" + f.Label + "}"
 	}
+	return s + "\n\\end{figure}\n"
 }
 
-func addTeXlines(s string) {
-	if o.Indent < 0 {
-		o.Indent = 0
+// Escapes alt text for \BeginAccSupp, which turns it into a PDF string.
+func escapeAlt(s string) string {
+	return strings.NewReplacer("\\", "\\textbackslash{}", "{", "\\{", "}", "\\}",
+		"%", "\\%", "#", "\\#", "$", "\\$", "&", "\\&", "_", "\\_",
+		"^", "\\textasciicircum{}", "~", "\\textasciitilde{}").Replace(s)
+}
+
+func figureMD(f Figure) string {
+	if f.Caption == "" {
+		attrs := []string{}
+		if f.Width != "" {
+			attrs = append(attrs, "width="+htmlLength(f.Width))
+		}
+		if f.Height != "" {
+			attrs = append(attrs, "height="+htmlLength(f.Height))
+		}
+		a := ""
+		if len(attrs) > 0 {
+			a = "{" + strings.Join(attrs, " ") + "}"
+		}
+		return "![" + f.Alt + "](" + f.Path + ")" + a + "\n"
 	}
-	s = strings.Repeat(" ", o.Tab*o.Indent) + s
-	if SlidesOnly && NotesOnly {
-		error("Logic bomb on line number "+strconv.Itoa(line_number)+"!", "Notes Only AND Slides Only")
+	id := ""
+	if f.Label != "" {
+		id = " id=\"" + f.Label + "\""
 	}
-	if SlidesOnly {
-		slidesTeXlines = append(slidesTeXlines, s)
-	} else if NotesOnly {
-		notesTeXlines = append(notesTeXlines, s)
-	} else {
-		notesTeXlines = append(notesTeXlines, s)
-		slidesTeXlines = append(slidesTeXlines, s)
+	style := ""
+	if f.Width != "" {
+		style += "width: " + htmlLength(f.Width) + ";"
+	}
+	if f.Height != "" {
+		style += "height: " + htmlLength(f.Height) + ";"
+	}
+	if style != "" {
+		style = " style=\"" + style + "\""
 	}
+	img := "<img src=\"" + f.Path + "\" alt=\"" +
+		strings.Replace(f.Alt, "\"", "&quot;", -1) + "\"" + style + " />\n"
+	if f.Path == "" {
+		img = "<p>" + placeholder + "</p>\n"
+	}
+	return "\n<figure" + id + ">\n" + img +
+		"<figcaption>Figure " + strconv.Itoa(f.Number) + ": " +
+		inlineHTML(f.Caption) + "</figcaption>\n</figure>\n\n"
+}
 
-	re_nonMD := regexp.MustCompile(`\[\w+\]`)
-	if regexp.MustCompile(`^(\%)`).FindStringIndex(md_line) == nil && SlidesOnly == false {
-		// remove processing intructions, e.g. [no]
-		if re_nonMD.FindStringIndex == nil {
-			info("Found non-Markdown content:" + md_line)
-		}
-		// FIXME: for some reason, some lines end up repeated
-		// in the MD file.  The condition below is a dirty
-		// hack until I can find the real reason
-		mdl := len(markdownLines)
-		if mdl < 1 {
-			markdownLines = append(markdownLines, "\n")
-			mdl = len(markdownLines)
+/******************************************************************************
+ A gallery is a list of images, each with a caption and some commentary:
+
+     gallery {cols=2 rows=2}
+     ![Caption](img/a.png) Commentary about the first image,
+         which may carry on over indented lines.
+     ![Another caption](img/b.png){alt="..."} More commentary.
+
+ The gallery ends at the first blank line.  In the notes, each image sits
+ beside its commentary.  On the slides, the images are shown cols by rows
+ to a frame (by default one to a frame), with their captions; frames after
+ the first are continuations of the current one.  The HTML is a grid that
+ fits as many images across as the window allows.
+
+******************************************************************************/
+
+type Gallery struct {
+	Items []GalleryItem
+	Cols  int     // Images across a slide
+	Rows  int     // Images down a slide
+	Width float64 // Fraction of the notes' line width taken by the images
+}
+
+type GalleryItem struct {
+	Figure
+	Text string // The commentary
+}
+
+// The number of lines in the gallery that starts on line i.
+func galleryLength(lines []string, i int) int {
+	n := 1
+	for i+n < len(lines) && !blank(lines[i+n]) {
+		n++
+	}
+	return n
+}
+
+func parseGallery(lines []string, i int) (Gallery, int) {
+	n := galleryLength(lines, i)
+	g := Gallery{Cols: 1, Rows: 1, Width: 0.4}
+	_, attrs := splitAttrs(strings.TrimSpace(strings.TrimPrefix(lines[i], "gallery")))
+	for k, v := range attrs {
+		switch k {
+		case "cols", "rows":
+			c, e := strconv.Atoi(v)
+			if e != nil || c < 1 {
+				warn("ignoring bad gallery option " + k + "=" + v + " on line " +
+					strconv.Itoa(line_number))
+				continue
+			}
+			if k == "cols" {
+				g.Cols = c
+				if attrs["rows"] == "" && c > 1 {
+					g.Rows = 2
+				}
+			} else {
+				g.Rows = c
+			}
+		case "notes-width":
+			l := texLength(v, "width")
+			w, e := strconv.ParseFloat(strings.TrimSuffix(l, "\\linewidth"), 64)
+			if !strings.HasSuffix(l, "\\linewidth") || e != nil || w <= 0 || w >= 1 {
+				warn("gallery notes-width must be a percentage, not '" + v +
+					"' (line " + strconv.Itoa(line_number) + ")")
+				continue
+			}
+			g.Width = w
+		case "#", ".":
+			// An id or classes, which mean nothing to a gallery
+		default:
+			warn("ignoring unknown gallery option '" + k + "' on line " +
+				strconv.Itoa(line_number))
 		}
+	}
 
-		if markdownLines[mdl-1] != md_line+"\n" {
-			if regexp.MustCompile(`^%`).FindStringIndex(md_line) == nil &&
-				regexp.MustCompile(`^p`).FindStringIndex(md_line) == nil {
-				md_line = regexp.MustCompile(`^\[no\]`).ReplaceAllString(md_line, "")
-				markdownLines = append(markdownLines, md_line+"\n")
+	re_item := regexp.MustCompile(`^\s*!\[([^\]]*)\]\(([^)\s]+)\)(\{[^}]*\})?\s*(.*)$`)
+	for k := i + 1; k < i+n; k++ {
+		m := re_item.FindStringSubmatch(lines[k])
+		if m == nil {
+			if len(g.Items) == 0 || strings.TrimSpace(lines[k]) == lines[k] {
+				error("Line "+strconv.Itoa(line_number+k-i)+" of the gallery is neither an image nor indented commentary", lines[k])
+				continue
 			}
+			last := &g.Items[len(g.Items)-1]
+			last.Text = strings.TrimSpace(last.Text + " " + strings.TrimSpace(lines[k]))
+			continue
 		}
+		_, attrs := splitAttrs(m[3])
+		item := GalleryItem{Figure{Path: m[2], Caption: strings.TrimSpace(m[1])}, m[4]}
+		imageAttrs(&item.Figure, attrs)
+		g.Items = appendAny(g.Items, item)
+	}
+	if len(g.Items) == 0 {
+		warn("the gallery on line " + strconv.Itoa(line_number) + " has no images")
 	}
+	return g, n
 }
 
-func pushEnv(env string, content string) {
-	lines := ""
-	if Debug > 2 {
-		info("Pushing: " + env)
+func emitGallery(g Gallery) {
+	md_skip = true
+	tex := g
+	tex.Items = nil
+	html := ""
+	for _, item := range g.Items {
+		t := item
+		t.Path = imageFor(item.Path, "tex")
+		found, size := fileExists(t.Path, "")
+		if !found {
+			abort(item.Path + " does not exist")
+		}
+		fileSizes[t.Path] = size
+		totalSize += size
+		tex.Items = appendAny(tex.Items, t)
+		item.Path = imageFor(item.Path, "html")
+		html += galleryItemHTML(item)
 	}
-	switch env {
-	case "section":
-		popEnvs()
-		o.Indent = 0
-		tmp := false
-		hasStyle := false
-		frameStyle := ""
+	addMDlines("\n<div class=\"gallery\" style=\"display: grid;" +
+		" grid-template-columns: repeat(auto-fill, minmax(14em, 1fr)); gap: 1em;\">\n" +
+		html + "</div>\n\n")
+	addNotesSlides(galleryNotes(tex), gallerySlides(tex))
+}
 
-		if strings.Contains(content, "[") { // Detect the frame style for Beamer slides
-			frameStyle = substr(content, "[", "]", false)
-			frameStyle = substr(content, "[", "]", true)
-			content = strings.TrimRight(content, frameStyle)
-			info("Frame contains styling: " + content + frameStyle)
-			hasStyle = true
-		} else {
-			if SlidesOnly {
-				frameStyle = "[noframenumbering]"
-				hasStyle = true
-			}
+// Each image beside its caption and commentary
+func galleryNotes(g Gallery) string {
+	w := strconv.FormatFloat(g.Width, 'f', 2, 64)
+	t := strconv.FormatFloat(1-g.Width-colGap, 'f', 2, 64)
+	s := ""
+	for _, item := range g.Items {
+		p := item.Notes
+		if graphicsArgs(p) == "" {
+			p.Args = []string{"width=\\linewidth"}
 		}
-		if !SlidesOnly {
-			tmp = NotesOnly
-			NotesOnly = true
-			addTeXlines("\n\\section{" + content + "}\n\\normalsize\n")
-			NotesOnly = tmp
+		text := process_md(item.Text)
+		if item.Caption != "" {
+			text = "\\textbf{" + process_md(item.Caption) + "}\\par\n" + text
 		}
+		// \vspace{0pt} aligns the tops of the image and the text
+		s += "\\par\\noindent\n" +
+			"\\begin{minipage}[t]{" + w + "\\linewidth}\n\\vspace{0pt}\n" +
+			figureTeX(Figure{Path: item.Path, Alt: item.Alt}, p) +
+			"\\end{minipage}\\hfill\n" +
+			"\\begin{minipage}[t]{" + t + "\\linewidth}\n\\vspace{0pt}\n" +
+			text + "\n\\end{minipage}\n\\par\\medskip\n"
+	}
+	return s
+}
 
-		tmp = SlidesOnly
-		SlidesOnly = true
-		addTeXlines("\\end{frame}\n\n" + "\\begin{frame}")
-		if hasStyle {
-			addTeXlines(frameStyle)
-		} else {
-			//			addTeXlines("[plain]")
+// The images cols by rows to a frame, with their captions
+func gallerySlides(g Gallery) string {
+	perFrame := g.Cols * g.Rows
+	if perFrame < len(g.Items) && !canSplitFrame("gallery") {
+		perFrame = len(g.Items)
+	}
+	height := strconv.FormatFloat(0.7/float64(g.Rows), 'f', 2, 64)
+	width := strconv.FormatFloat(0.95/float64(g.Cols), 'f', 2, 64)
+	s := ""
+	for k, item := range g.Items {
+		if k > 0 && k%perFrame == 0 {
+			slidesCount++
+			s += "\\end{frame}\n\n\\begin{frame}" + frame_style +
+				"\\frametitle{" + strings.TrimSpace(frame_title) + " (cont.)}\n"
+		}
+		if k%g.Cols == 0 {
+			s += "\\begin{columns}[t]\n"
+		}
+		p := item.Slides
+		if graphicsArgs(p) == "" {
+			p.Args = []string{"width=\\linewidth", "height=" + height + "\\textheight",
+				"keepaspectratio"}
+		}
+		s += "\\begin{column}{" + width + "\\textwidth}\n\\centering\n" +
+			figureTeX(Figure{Path: item.Path, Alt: item.Alt}, p)
+		if item.Caption != "" {
+			s += "{\\small " + process_md(item.Caption) + "}\n"
+		}
+		s += "\\end{column}\n"
+		if k%g.Cols == g.Cols-1 || k == len(g.Items)-1 {
+			s += "\\end{columns}\n"
 		}
-		addTeXlines("\\frametitle{" + content + "}\n")
-		SlidesOnly = tmp
-	case "item":
-		lines = "\\item " + content + "\n"
-	case "itemize":
-		o.Indent++
-		lines = "\\begin{itemize}" + content + "\n"
-	case "enumerate":
-		o.Indent++
-		lines = "\\begin{enumerate}\n"
-	case "description":
-		o.Indent++
-		lines = "\\begin{description}\n"
-	case "tabular":
-		pushEnv("center", "")
-		lines = "\\begin{tabular}" + content + "\n\\toprule\n"
-	case "center":
-		lines = "\\begin{center}\n" + content + "\n"
-	case "quote":
-		lines = "\\begin{quote}\n" + content + "\n"
-	case "include":
-		lines = content + "\n"
 	}
+	return s
+}
 
-	if env == "item" {
-		o.Indent++
-		addTeXlines(lines)
-		o.Indent--
-	} else {
-		push(env, envStack)
-		if env != "section" {
-			addTeXlines(lines)
-		}
+func galleryItemHTML(item GalleryItem) string {
+	caption := inlineHTML(item.Text)
+	if item.Caption != "" {
+		caption = "<strong>" + inlineHTML(item.Caption) + "</strong> " + caption
 	}
+	return "<figure>\n<img src=\"" + item.Path + "\" alt=\"" +
+		strings.Replace(item.Alt, "\"", "&quot;", -1) +
+		"\" style=\"width: 100%;\" />\n" +
+		"<figcaption>" + strings.TrimSpace(caption) + "</figcaption>\n</figure>\n"
 }
 
-func popEnv(message string) {
-	env := envStack[0]
-	if Debug > 2 {
-		info("Popping: " + env)
+/*******************************************************************************
+*                                                                              *
+* The image pipeline.  Each output has the image formats it prefers: PDF for  *
+* TeX and SVG for HTML, with bitmaps as a fallback.  imageFor picks the best   *
+* variant of an image that exists (e.g. img/cat.pdf for img/cat.svg), and if   *
+* there isn't one, converts the image with whichever local tool is available,  *
+* into the build cache.  The manifest in the cache records what was made from  *
+* what.                                                                        *
+*                                                                              *
+*******************************************************************************/
+
+var imageExts = []string{".pdf", ".svg", ".png", ".jpg", ".jpeg", ".eps", ".gif"}
+
+// The formats each output can use, best first
+var imagePrefs = map[string][]string{
+	"tex":  {".pdf", ".png", ".jpg", ".jpeg"},
+	"html": {".svg", ".png", ".jpg", ".jpeg"},
+}
+
+// Ways of converting between formats, best first.  {in} and {out} are
+// replaced by the file names, and {outbase} by the output minus extension.
+var converters = map[string][][]string{
+	".svg>.pdf": {
+		{"rsvg-convert", "-f", "pdf", "-o", "{out}", "{in}"},
+		{"inkscape", "{in}", "--export-filename={out}"},
+		{"convert", "{in}", "{out}"},
+	},
+	".svg>.png": {
+		{"rsvg-convert", "-f", "png", "-d", "150", "-p", "150", "-o", "{out}", "{in}"},
+		{"inkscape", "{in}", "--export-dpi=150", "--export-filename={out}"},
+		{"convert", "-density", "150", "{in}", "{out}"},
+	},
+	".pdf>.svg": {
+		{"inkscape", "{in}", "--export-filename={out}"},
+		{"pdftocairo", "-svg", "{in}", "{out}"},
+	},
+	".pdf>.png": {
+		{"pdftocairo", "-png", "-singlefile", "-r", "150", "{in}", "{outbase}"},
+		{"convert", "-density", "150", "{in}[0]", "{out}"},
+	},
+	".eps>.pdf": {
+		{"epstopdf", "{in}", "--outfile={out}"},
+		{"convert", "{in}", "{out}"},
+	},
+	".eps>.png": {{"convert", "-density", "150", "{in}", "{out}"}},
+	".gif>.png": {{"convert", "{in}[0]", "{out}"}},
+}
+
+// Generated file -> "source<TAB>tool", saved to the cache by saveManifest
+var manifest map[string]string
+
+// Splits an image path into the path without its extension, and the
+// extension, if it is an image extension.
+func imageBase(path string) (string, string) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range imageExts {
+		if ext == e {
+			return strings.TrimSuffix(path, filepath.Ext(path)), ext
+		}
 	}
-	s := ""
-	o.Indent--
+	return path, ""
+}
 
-	if env == "tabular" {
-		in_table = true
-	} else {
-		in_table = false
+// Where a generated file goes in the cache.
+func cachePath(path string) string {
+	p := filepath.ToSlash(filepath.Clean(path))
+	p = strings.Replace(p, "../", "__/", -1)
+	return filepath.Join(o.cacheDir, strings.TrimPrefix(p, "/"))
+}
+
+// Whether a generated file exists and is newer than its source.
+func upToDate(out string, src string) bool {
+	so, e1 := os.Stat(out)
+	si, e2 := os.Stat(src)
+	return e1 == nil && e2 == nil && !so.ModTime().Before(si.ModTime())
+}
+
+// Returns the file to use for an image in the given output ("tex" or
+// "html"), converting it if need be.  Returns the path unchanged if there
+// is nothing better, or nothing at all.
+func imageFor(path string, output string) string {
+	base, ext := imageBase(path)
+
+	// The existing variants of the image, i.e. the possible sources
+	sources := []string{}
+	if ext != "" {
+		if found, _ := fileExists(path, ""); found {
+			sources = append(sources, path)
+		}
+	}
+	for _, e := range imageExts {
+		if found, _ := fileExists(base+e, ""); found && base+e != path {
+			sources = append(sources, base+e)
+		}
 	}
 
-	switch env {
-	case "itemize":
-		s = "\\end{itemize}" + message + "\n"
-		if image_used {
-			addTeXlines("\\renewcommand\\labelitemi{-}\n")
-			image_used = false
+	// The best variant that already exists, or has already been made
+	for _, want := range imagePrefs[output] {
+		for _, src := range sources {
+			if strings.ToLower(filepath.Ext(src)) == want {
+				return src
+			}
 		}
-		o.Indent++
-	case "enumerate", "description", "tabular", "center", "quote":
-		s = ""
-		if in_table {
-			s = s + "\\bottomrule\n"
-			in_table = false
+		out := cachePath(base + want)
+		if src, ok := manifest[out]; ok && upToDate(out, strings.Split(src, "\t")[0]) {
+			return out
 		}
-		s = s + "\\end{" + env + "}" + message + "\n"
-		o.Indent++
-	default:
-		if Debug > 1 {
-			error("Unknown environment popped!", env)
+	}
+
+	// Make one
+	for _, want := range imagePrefs[output] {
+		for _, src := range sources {
+			if out, ok := convertImage(src, base+want); ok {
+				return out
+			}
 		}
 	}
-	pop(envStack)
-	if o.Indent < 0 {
-		o.Indent = 0
+	if len(sources) > 0 {
+		error("Can't convert "+path+" to a format that suits "+output,
+			"install rsvg-convert, inkscape or ImageMagick")
 	}
-	addTeXlines(s)
-	o.Indent--
+	return path
 }
 
-func popEnvs() {
-	in_table = false
-	l := len(envStack)
-	if l > 0 {
-		for i := range envStack {
-			if len(envStack[i]) != 0 {
-				popEnv(" % auto-closed by popEnvs()")
-				i++
+// Converts src to the format of target (a path), writing it to the cache.
+func convertImage(src string, target string) (string, bool) {
+	from := strings.ToLower(filepath.Ext(src))
+	to := strings.ToLower(filepath.Ext(target))
+	out := cachePath(target)
+
+	for _, c := range converters[from+">"+to] {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			error("Can't create the image cache", err.Error())
+			return "", false
+		}
+		args := make([]string, len(c)-1)
+		for k, a := range c[1:] {
+			a = strings.Replace(a, "{in}", src, -1)
+			a = strings.Replace(a, "{outbase}", strings.TrimSuffix(out, to), -1)
+			args[k] = strings.Replace(a, "{out}", out, -1)
+		}
+		if runProg(c[0], args) {
+			if found, _ := fileExists(out, ""); found {
+				info("Converted " + src + " to " + out + " with " + c[0])
+				manifest[out] = src + "\t" + c[0]
+				return out, true
 			}
 		}
 	}
+	return "", false
 }
-func makeCommon() string {
-	h := "\\hypersetup{\n" +
-		fmt.Sprintf("    pdftitle    = {%s: %s},\n",
-			o.CourseCode, o.CourseName) +
-		fmt.Sprintf("    pdfsubject  = {%s},    \n",
-			o.LectureTitle) +
-		fmt.Sprintf("    pdfkeywords = {%s  %s},\n",
-			o.CourseName, o.LectureTitle) +
-		fmt.Sprintf("    pdfauthor   = {%s, %s},\n",
-			o.Author1, o.Affiliation)
 
-	return (o.TeXPreambleCommon + h + o.TeXBeginDocument)
+func loadManifest() {
+	manifest = make(map[string]string)
+	if found, _ := fileExists(filepath.Join(o.cacheDir, "manifest"), ""); !found {
+		return
+	}
+	for _, l := range readInput(filepath.Join(o.cacheDir, "manifest")) {
+		f := strings.SplitN(l, "\t", 2)
+		if len(f) == 2 && !strings.HasPrefix(l, "#") {
+			manifest[f[0]] = f[1]
+		}
+	}
 }
 
-/**************************************************************************
-*
-* Write the notes file, then run pdflatex and clean up afterwards
-*
-**************************************************************************/
-func writeNotes(filename string, r chan bool) {
-	notesTitle := fmt.Sprintf("\\title{%s: %s\\\\%s}\n",
-		o.CourseCode, o.CourseName, o.LectureTitle)
-	notesAuthor := fmt.Sprintf("\\author{%s\\\\\\href{mailto:%s}{%s}",
-		o.Author1, o.Email1, o.Email1)
-	if o.Author2 != "" {
-		notesAuthor += fmt.Sprintf("\\\\  \\\\ %s\\\\ \\href{mailto:%s}{%s}", o.Author2, o.Email2, o.Email2)
+func saveManifest() {
+	if len(manifest) == 0 {
+		return
 	}
-	notesAuthor += "}\n\n"
-	notesTop := o.notesTeXPreamble + notesTitle + notesAuthor +
-		"\\lfoot{" + o.CourseCode + " (" +
-		strings.TrimSpace(o.Date) + ")}\n" +
-		//		"\\cfoot{page \\thepage}\n" +
-		"\\rfoot{" + o.LectureTitle + "}\n"
-	if o.Date != "" {
-		notesTop += o.Date
+	keys := make([]string, 0, len(manifest))
+	for k := range manifest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := "# Generated file\tsource\ttool\n"
+	for _, k := range keys {
+		s += k + "\t" + manifest[k] + "\n"
 	}
+	writeOutput(filepath.Join(o.cacheDir, "manifest"), strings.TrimSuffix(s, "\n"))
+}
 
-	notesTop += makeCommon() + o.notesTeXBeginDoc
-	popEnvs()
-	notesBottom := "\n\\printbibliography\n"
-	notesBottom += "\\end{document}\n"
-	s := notesTop + strings.Join(notesTeXlines, "") + notesBottom
+/*******************************************************************************
+*                                                                              *
+* Bitmap quality.  A bitmap's effective resolution is its width in pixels     *
+* divided by the width it is printed at, which depends on how it is scaled in *
+* the notes and on the slides.  Images below MinDPI are reported.  With        *
+* Downsample = true, images far above MaxDPI are shrunk to MaxDPI, and the     *
+* "web" build profile (-p web) recompresses bitmaps to fit ImageBudget (KB).   *
+*                                                                              *
+*******************************************************************************/
 
-	// The TeX code is done, now write it to a file and run the
-	// external tools on it
-	fs := strings.Split(filename, ".")
+// The size and resolution of a bitmap.  The resolution comes from the file
+// (PNG pHYs or JFIF density), or is 72 dpi, as TeX assumes.
+type Bitmap struct {
+	Width  int
+	Height int
+	DPI    float64
+	Format string
+}
 
-	f := strings.ToLower(fs[0]) + "-notes"
-	o.NotesFileName = f + ".tex"
-	writeOutput(o.NotesFileName, s)
-	if run_TeX {
-		info("====> Formatting notes with TeX")
-		res := runTeX(f, "notes")
-		if res {
-			flist := f + ".aux " + f + ".log " +
-				f + ".out " + f + ".run.xml " + f + ".bcf"
-			if o.hasCitations {
-				flist += f + ".bbl " + f + ".blg " + f + ".bcf"
+func isBitmap(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".png" || ext == ".jpg" || ext == ".jpeg"
+}
+
+func readBitmap(path string) (Bitmap, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Bitmap{}, false
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		warn("can't read the image " + path + ": " + err.Error())
+		return Bitmap{}, false
+	}
+	b := Bitmap{Width: cfg.Width, Height: cfg.Height, DPI: 72, Format: format}
+
+	if format == "png" {
+		// Walk the chunks looking for pHYs
+		for k := 8; k+12 <= len(data); {
+			n := int(binary.BigEndian.Uint32(data[k:]))
+			if string(data[k+4:k+8]) == "pHYs" && n >= 9 && k+17 <= len(data) &&
+				data[k+16] == 1 {
+				b.DPI = float64(binary.BigEndian.Uint32(data[k+8:])) * 0.0254
+				break
 			}
-			cleanUp(flist)
-		} else {
-			info("Because of the previous error, I can't continue processing" +
-				" the notes.")
-			r <- false
+			k += 12 + n
+		}
+	} else if format == "jpeg" && len(data) > 18 && string(data[6:11]) == "JFIF\x00" {
+		d := float64(binary.BigEndian.Uint16(data[14:]))
+		switch data[13] {
+		case 1:
+			b.DPI = d
+		case 2:
+			b.DPI = d * 2.54
 		}
-	} else {
-		debug("run_TeX is false?!?")
 	}
-	r <- true
+	if b.DPI < 1 {
+		b.DPI = 72
+	}
+	return b, true
 }
 
-/*******************************************************************************
-*
-* This function writes the LaTeX code for a Beamer presentation, then runs
-* pdflatex on it.
-*
-*******************************************************************************/
-func writeSlides(f string, r chan bool) {
-	beamerOptions := o.slidesTeXBeginDoc + fmt.Sprintf(
-		"\\title{%s}\n"+
-			"\\subtitle{%s %s}\n",
-		o.LectureTitle, o.CourseCode, o.CourseName)
+// Converts a TeX length to inches.  Lengths relative to the line width
+// use lineWidth; other relative lengths can't be worked out, so give 0.
+func inches(l string, lineWidth float64) float64 {
+	l = strings.TrimSpace(l)
+	m := regexp.MustCompile(`^([\d.]*)\s*(\\linewidth|\\textwidth|\\columnwidth|cm|mm|in|pt|bp)$`).FindStringSubmatch(l)
+	if m == nil {
+		return 0
+	}
+	n := 1.0
+	if m[1] != "" {
+		n, _ = strconv.ParseFloat(m[1], 64)
+	}
+	switch m[2] {
+	case "cm":
+		return n / 2.54
+	case "mm":
+		return n / 25.4
+	case "in":
+		return n
+	case "pt":
+		return n / 72.27
+	case "bp":
+		return n / 72
+	}
+	return n * lineWidth
+}
 
-	if o.Author2 != "" {
+// Works out how wide (in inches) a bitmap will be printed with the given
+// \includegraphics arguments, on a line lineWidth inches wide.
+func printedWidth(b Bitmap, args string, lineWidth float64) float64 {
+	natural := float64(b.Width) / b.DPI
+	w := natural
+	for _, kv := range strings.Split(args, ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(pair[0]) {
+		case "scale":
+			if sc, e := strconv.ParseFloat(strings.TrimSpace(pair[1]), 64); e == nil {
+				w = natural * sc
+			}
+		case "width":
+			if x := inches(pair[1], lineWidth); x > 0 {
+				return x
+			}
+		case "height":
+			if x := inches(pair[1], lineWidth); x > 0 {
+				return x * float64(b.Width) / float64(b.Height)
+			}
+		}
+	}
+	return w
+}
 
-		beamerOptions += fmt.Sprintf("\\author{\n"+
-			"\\small\n"+
-			"\\texorpdfstring{\n"+
-			"  \\begin{columns}\n"+
-			"    \\column{0.45\\linewidth}\n      \\centering\n"+
-			"      %s\\newline\\href{%s}{%s}\n"+
-			"    \\column{0.45\\linewidth}\n      \\centering\n"+
-			"      %s\\newline\\href{%s}{%s}\n"+
-			"  \\end{columns}\n }{Nothing}\n}\n\n",
-			o.Author1, o.Email1, o.Email1,
-			o.Author2, o.Email2, o.Email2)
-	} else {
-		beamerOptions += fmt.Sprintf("\\author{%s\n\\newline$<$\\href{mailto:%s}{%s}$>$}\n\n",
-			o.Author1, o.Email1, o.Email1)
+// Checks the resolution of a figure's bitmap in the notes and slides, and
+// returns the figure with a smaller or recompressed bitmap if need be.
+func checkBitmap(f Figure) Figure {
+	b, ok := readBitmap(f.Path)
+	if !ok {
+		return f
+	}
+	notesLine, slidesLine := o.notesTextWidth/2.54, o.slidesTextWidth/2.54
+	if columns.Open {
+		notesLine *= columns.Widths[columns.Col]
+		slidesLine *= columns.Widths[columns.Col]
+	}
+
+	widest := 0.0
+	for _, use := range []struct {
+		output string
+		args   string
+		line   float64
+		used   bool
+	}{
+		{"notes", graphicsArgs(f.Notes), notesLine, !SlidesOnly},
+		{"slides", graphicsArgs(f.Slides), slidesLine, !NotesOnly},
+	} {
+		if !use.used {
+			continue
+		}
+		w := printedWidth(b, use.args, use.line)
+		dpi := float64(b.Width) / w
+		debug(f.Path + " is " + strconv.Itoa(int(dpi)) + " dpi in the " + use.output)
+		if dpi < float64(o.minDPI) {
+			warn(fmt.Sprintf("%s (line %d) is only %.0f dpi in the %s "+
+				"(%d pixels across %.1f cm); at least %d dpi is needed",
+				f.Path, line_number, dpi, use.output, b.Width, w*2.54, o.minDPI))
+		}
+		widest = math.Max(widest, w)
+	}
+
+	// Shrink images with far more pixels than the printed size needs
+	target := b.Width
+	if o.downsample && widest > 0 && float64(b.Width)/widest > float64(o.maxDPI)*1.1 {
+		target = int(math.Ceil(widest * float64(o.maxDPI)))
+	}
+	budget := 0
+	if _, size := fileExists(f.Path, ""); profile == "web" && size > uint64(o.imageBudget*1024) {
+		budget = o.imageBudget * 1024
+	}
+	if target == b.Width && budget == 0 {
+		return f
+	}
+
+	out, width, ok := shrinkBitmap(f.Path, b, target, budget)
+	if !ok {
+		return f
+	}
+	// Scale so that the printed size stays the same.  The new file has
+	// no resolution of its own, so TeX takes it as 72 dpi.
+	rescale := func(p *Placement) {
+		args := graphicsArgs(*p)
+		if strings.Contains(args, "width") || strings.Contains(args, "height") {
+			return
+		}
+		sc := 1.0
+		if p.Scale != "" {
+			sc, _ = strconv.ParseFloat(p.Scale, 64)
+		}
+		p.Scale = strconv.FormatFloat(sc*float64(b.Width)/b.DPI/(float64(width)/72), 'f', 3, 64)
+	}
+	rescale(&f.Notes)
+	rescale(&f.Slides)
+	f.Path = out
+	return f
+}
+
+// Writes a copy of a bitmap to the cache, at most width pixels wide, and
+// (if budget > 0) recompressed to fit in budget bytes.  Returns the copy
+// and its width.
+func shrinkBitmap(path string, b Bitmap, width int, budget int) (string, int, bool) {
+	base, ext := imageBase(path)
+	suffix := "-" + strconv.Itoa(width)
+	if budget > 0 {
+		suffix += "-web"
+	}
+	out := cachePath(base + suffix + ext)
+	if src, ok := manifest[out]; ok && upToDate(out, strings.Split(src, "\t")[0]) {
+		if nb, ok := readBitmap(out); ok {
+			return out, nb.Width, true
+		}
+	}
+
+	fi, err := os.Open(path)
+	if err != nil {
+		return "", 0, false
+	}
+	img, _, err := image.Decode(fi)
+	fi.Close()
+	if err != nil {
+		warn("can't decode " + path + ": " + err.Error())
+		return "", 0, false
+	}
+
+	var data []byte
+	quality := 90
+	for {
+		if width < b.Width {
+			img = resample(img, width, int(math.Round(float64(b.Height)*float64(width)/float64(b.Width))))
+		}
+		var buf bytes.Buffer
+		if b.Format == "jpeg" {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		} else {
+			err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+		}
+		if err != nil {
+			warn("can't encode " + out + ": " + err.Error())
+			return "", 0, false
+		}
+		data = buf.Bytes()
+		if budget == 0 || len(data) <= budget || width < 200 {
+			break
+		}
+		// Over budget: lower the JPEG quality, then the size
+		if b.Format == "jpeg" && quality > 50 {
+			quality -= 10
+		} else {
+			b.Width, b.Height = img.Bounds().Dx(), img.Bounds().Dy()
+			width = int(float64(width) * 0.8)
+		}
+	}
+	if budget > 0 && len(data) > budget {
+		warn(path + " is still " + humanize.Bytes(uint64(len(data))) + " after recompression")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		error("Can't create the image cache", err.Error())
+		return "", 0, false
+	}
+	if err := ioutil.WriteFile(out, data, 0644); err != nil {
+		error("Can't write "+out, err.Error())
+		return "", 0, false
+	}
+	info("Resampled " + path + " to " + strconv.Itoa(width) + " pixels wide (" +
+		humanize.Bytes(uint64(len(data))) + ")")
+	manifest[out] = path + "\tsnp"
+	return out, width, true
+}
+
+// Shrinks an image to w x h pixels by averaging the pixels that fall in
+// each new pixel.
+func resample(img image.Image, w, h int) image.Image {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := src.Min.Y + y*src.Dy()/h
+		y1 := src.Min.Y + (y+1)*src.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0 := src.Min.X + x*src.Dx()/w
+			x1 := src.Min.X + (x+1)*src.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			k := (y*w + x) * 4
+			dst.Pix[k] = uint8(r / n >> 8)
+			dst.Pix[k+1] = uint8(g / n >> 8)
+			dst.Pix[k+2] = uint8(bl / n >> 8)
+			dst.Pix[k+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+/*******************************************************************************
+*                                                                              *
+* Display math.  An equation on lines of its own, in $$ ... $$ or \[ ... \],   *
+* goes to TeX as it is, and is numbered if it has a label:                     *
+*                                                                              *
+*     $$ E = mc^2 $$ {#eq:energy}                                              *
+*                                                                              *
+* It can then be referred to as @eq:energy.  Math environments such as align   *
+* are passed through whole, and their equations counted, so that the numbers   *
+* in the HTML agree with TeX's.  The Markdown file keeps the math in Pandoc's  *
+* syntax; Pandoc renders it as MathML, or with KaTeX (see HTMLMath).           *
+*                                                                              *
+*******************************************************************************/
+
+type Equation struct {
+	TeX    string // The math without its delimiters, or a whole environment
+	Env    string // The environment, e.g. align*, if there is one
+	Label  string
+	Number int // The (first) equation number, or 0 if unnumbered
+}
+
+var re_math_env = regexp.MustCompile(`^\s*\\begin\{((equation|align|gather|multline|eqnarray|flalign|alignat)\*?)\}`)
+
+// Tries to read a display equation starting at lines[i].  Returns it and
+// the number of lines it used, which is zero if there isn't one.
+func parseEquation(lines []string, i int) (Equation, int) {
+	first := strings.TrimSpace(lines[i])
+	if m := re_math_env.FindStringSubmatch(first); m != nil {
+		end := "\\end{" + m[1] + "}"
+		for j := i; j < len(lines); j++ {
+			if strings.Contains(lines[j], end) {
+				return Equation{TeX: strings.Join(lines[i:j+1], "\n"), Env: m[1]}, j - i + 1
+			}
+		}
+		return Equation{}, 0
+	}
+
+	open, close := "$$", "$$"
+	if strings.HasPrefix(first, "\\[") {
+		open, close = "\\[", "\\]"
+	} else if !strings.HasPrefix(first, "$$") {
+		return Equation{}, 0
+	}
+	text := strings.TrimPrefix(first, open)
+	for j := i; j < len(lines); j++ {
+		if j > i {
+			text += "\n" + lines[j]
+		}
+		k := strings.Index(text, close)
+		if k < 0 {
+			continue
+		}
+		rest, attrs := splitAttrs(text[k+len(close):])
+		if strings.TrimSpace(rest) != "" {
+			return Equation{}, 0 // More text follows: it's part of a paragraph
+		}
+		return Equation{TeX: strings.TrimSpace(text[:k]), Label: attrs["#"]}, j - i + 1
+	}
+	return Equation{}, 0
+}
+
+// The numbered rows of a math environment: one per equation, less those
+// marked \nonumber or \notag.
+func envRows(e Equation) []string {
+	if strings.HasSuffix(e.Env, "*") {
+		return nil
+	}
+	if e.Env == "equation" || e.Env == "multline" {
+		return []string{e.TeX}
+	}
+	rows := []string{}
+	for _, r := range strings.Split(e.TeX, "\\\\") {
+		if !strings.Contains(r, "\\nonumber") && !strings.Contains(r, "\\notag") &&
+			strings.TrimSpace(strings.Split(r, "\\end{")[0]) != "" {
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+func emitEquation(e Equation) {
+	md_skip = true
+	if e.Env != "" {
+		// Pandoc understands math environments in Markdown
+		addMDlines("\n" + e.TeX + "\n\n")
+		addNotesSlides(e.TeX+"\n", e.TeX+"\n")
+		equationCount += len(envRows(e))
+		return
+	}
+	if e.Label == "" {
+		addMDlines("\n$$" + e.TeX + "$$\n\n")
+		addNotesSlides("\\[\n"+e.TeX+"\n\\]\n", "\\[\n"+e.TeX+"\n\\]\n")
+		return
+	}
+	equationCount++
+	n := strconv.Itoa(equationCount)
+	addMDlines("\n[$$" + e.TeX + "\\qquad(" + n + ")$$]{#" + e.Label + " .equation}\n\n")
+	// The counter is set by hand, as for figures
+	tex := "\\setcounter{equation}{" + strconv.Itoa(equationCount-1) + "}\n" +
+		"\\begin{equation}\n" + e.TeX + "\n\\label{" + e.Label + "}\n\\end{equation}\n"
+	addNotesSlides(tex, tex)
+}
+
+/*******************************************************************************
+*                                                                              *
+* Cross-references.  Before the source is processed, collectLabels numbers    *
+* everything that can be referred to, so that references can be resolved in   *
+* the Markdown file even when they point forwards.  A reference looks like     *
+* @fig:label.                                                                  *
+*                                                                              *
+*******************************************************************************/
+
+// Something that can be referred to, e.g. a figure.
+type Label struct {
+	Kind   string
+	Number string
+}
+
+// The name used in the text for each kind of reference
+var refKinds = map[string]string{"fig": "Figure", "eq": "Equation", "sec": "Section",
+	"ex": "Exercise"}
+
+func addLabel(label string, l Label, n int) {
+	if label == "" {
+		return
+	}
+	if _, dup := labels[label]; dup {
+		error("Label "+label+" on line "+strconv.Itoa(n)+" is used more than once", "duplicate label")
+	}
+	labels[label] = l
+}
+
+// Sections get labels, so that @sec:label can refer to them.  The label is
+// given by a {#label} after the title, or made from the title as Pandoc
+// makes identifiers, e.g. "sec:what-is-a-monad".
+var re_sec_id = regexp.MustCompile(`\s*\{#([^}\s]+)\}`)
+
+// Splits the title of a section from its explicit label, if any, and its
+// frame style, if any.
+func sectionTitle(s string) (title, label string) {
+	if m := re_sec_id.FindStringSubmatch(s); m != nil {
+		label = strings.TrimPrefix(m[1], "sec:")
+		s = re_sec_id.ReplaceAllString(s, "")
+	}
+	if k := strings.Index(s, "["); k >= 0 {
+		s = s[:k]
+	}
+	return strings.TrimSpace(s), label
+}
+
+// Makes a label from a title, as Pandoc does: lower case, with
+// punctuation removed, spaces made hyphens, and anything before the first
+// letter dropped.
+func sectionSlug(title string) string {
+	slug := ""
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-.", r):
+			slug += string(r)
+		case unicode.IsSpace(r):
+			slug += "-"
+		}
+	}
+	slug = strings.TrimLeftFunc(slug, func(r rune) bool { return !unicode.IsLetter(r) })
+	if slug == "" {
+		slug = "section"
+	}
+	return slug
+}
+
+func collectLabels(lines []string) {
+	figures, equations, exercises := 0, 0, 0
+	sections := []int{0, 0, 0}
+	collecting = true
+	defer func() { collecting = false }()
+	skip := 0
+	verbatim := false // In [bv] ... [ev], as leave_alone is in processLines
+	for n, line := range lines {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		keys := strings.SplitN(line, " ", 2)
+		if keys[0] == "[bv]" || keys[0] == "[ev]" {
+			verbatim = keys[0] == "[bv]"
+			continue
+		}
+		if keys[0] == "gallery" {
+			// Gallery images aren't numbered figures
+			skip = galleryLength(lines, n) - 1
+			continue
+		}
+		if c, k := parseCode(lines, n); k > 0 && !verbatim {
+			skip = k - 1 // Nothing in code is a label or citation
+			if _, ok := diagramLangs[c.Lang]; ok && c.Attrs["caption"] != "" {
+				figures++
+				addLabel(c.Attrs["#"], Label{"fig", strconv.Itoa(figures)}, sourceLine(n))
+			}
+			continue
+		}
+		if id, text, k := parseFootnote(lines, n); k > 0 && !verbatim {
+			if _, ok := footnotes[id]; ok {
+				warn("footnote [^" + id + "] is defined twice (line " +
+					strconv.Itoa(sourceLine(n)) + ")")
+			}
+			footnotes[id] = text
+			skip = k - 1
+			citations(text, false)
+			continue
+		}
+		if e, k := parseEquation(lines, n); k > 0 && !verbatim {
+			skip = k - 1
+			if e.Env != "" {
+				// Labels inside environments are TeX's business, but
+				// they still need numbers for the Markdown file
+				for _, r := range envRows(e) {
+					equations++
+					if m := regexp.MustCompile(`\\label\{([^}]*)\}`).FindStringSubmatch(r); m != nil {
+						addLabel(m[1], Label{"eq", strconv.Itoa(equations)}, sourceLine(n))
+					}
+				}
+			} else if e.Label != "" {
+				equations++
+				addLabel(e.Label, Label{"eq", strconv.Itoa(equations)}, sourceLine(n))
+			}
+			continue
+		}
+		if kind, _, label, ok := parseDiv(line); ok && kind == "exercise" && !verbatim {
+			exercises++
+			addLabel(label, Label{"ex", strconv.Itoa(exercises)}, sourceLine(n))
+		}
+		if (keys[0] == "s" || strings.HasPrefix(keys[0], "#")) && len(keys) > 1 {
+			title, label := sectionTitle(keys[1])
+			if label == "" {
+				// Pandoc numbers identifiers that would be the same
+				label = sectionSlug(title)
+				for k := 1; labels["sec:"+label].Kind != ""; k++ {
+					label = sectionSlug(title) + "-" + strconv.Itoa(k)
+				}
+			}
+			// Number the section within its parents, e.g. 2.1
+			level := 1
+			if keys[0] != "s" {
+				level = len(keys[0]) - len(strings.TrimLeft(keys[0], "#"))
+			}
+			if level > 3 {
+				level = 3
+			}
+			sections[level-1]++
+			number := ""
+			for l, k := range sections {
+				if l < level {
+					number += "." + strconv.Itoa(k)
+				} else {
+					sections[l] = 0
+				}
+			}
+			addLabel("sec:"+label, Label{"sec", number[1:]}, sourceLine(n))
+			sectionLabels[n] = "sec:" + label
+		}
+		if !strings.HasPrefix(line, "%") {
+			citations(line, false)
+		}
+		f, isFigure := parseImageLine(line)
+		isFigure = isFigure && !verbatim
+		if keys[0] == "g" && len(keys) > 1 {
+			f, isFigure = parseGraphics(keys[1]), true
+		}
+		if isFigure && f.Caption != "" {
+			figures++
+			addLabel(f.Label, Label{"fig", strconv.Itoa(figures)}, sourceLine(n))
+		}
+	}
+}
+
+var re_ref = regexp.MustCompile(`@(\w+):([\w\-.:]*[\w\-])`)
+
+// Replaces references such as @fig:label with the number of the thing
+// referred to, linked to it, in either TeX or Markdown.  The TeX is
+// final, so escapeText resolves references itself rather than escape them.
+func resolveRefs(line string, md bool) string {
+	return re_ref.ReplaceAllStringFunc(line, func(ref string) string {
+		m := re_ref.FindStringSubmatch(ref)
+		name, ok := refKinds[m[1]]
+		if !ok {
+			return ref // Not a reference
+		}
+		label := m[1] + ":" + m[2]
+		l, found := labels[label]
+		if !found {
+			if !md {
+				error("Unknown reference "+ref+" on line "+strconv.Itoa(line_number), "no such label")
+			}
+			l.Number = "??"
+		}
+		number := l.Number
+		if m[1] == "eq" {
+			number = "(" + number + ")"
+		}
+		if md {
+			return "[" + name + " " + number + "](#" + label + ")"
+		}
+		if m[1] == "sec" && found {
+			// TeX numbers the sections of the notes itself
+			return name + "~\\ref{" + label + "}"
+		}
+		return "\\hyperref[" + label + "]{" + name + "~" + number + "}"
+	})
+}
+
+// Links section references to their numbers in documents without the
+// sections, such as the slides and the solutions.
+func sectionNumbers(body string) string {
+	re_sec := regexp.MustCompile(`\\ref\{(sec:[^}]*)\}`)
+	return re_sec.ReplaceAllStringFunc(body, func(ref string) string {
+		label := re_sec.FindStringSubmatch(ref)[1]
+		return "\\hyperlink{" + label + "}{" + labels[label].Number + "}"
+	})
+}
+
+func addItem(key string, item string) {
+	// This function adds an item to a list. It implements three
+	// types: itemize, enumerate and description.
+	// FIXME: It seems unreasonably long and complex. Can I factor
+	// out the markdown code, or make into (one-use) functions?
+	e := ""
+	inList := false
+	re_k := regexp.MustCompile(`^\s+\-|(\d\.)`) // First non-space item markers
+
+	re_b := regexp.MustCompile(`^\[\s([^\s]+?)\s\]\s+`) // [] Brackets
+
+	//re_n := regexp.MustCompile("^\\s*\\d+\\.")
+
+	// Are we already in a list environment, even if it's not the current one?
+	for i := range envStack {
+		e = envStack[i]
+		if e == "itemize" || e == "enumerate" || e == "description" {
+			inList = true
+			break
+		}
+	}
+
+	// Implement Markdown's list type based on list marker. FIXME:
+	// currently fails if two successive items have different list
+	// markers!
+	env := ""
+	// Key may be empty if the line starts with a space (i.e. is
+	// indented. If it is, make key the first non-space character.
+
+	if key == "" {
+		key = re_k.FindString(item)
+		//info("Empty key, replaced with '" + key + "'")
+	}
+	switch key {
+	case "-":
+		// Search for custom marker
+		if re_b.FindAllString(item, -1) != nil {
+			image_used = true
+			addTeXlines("\\renewcommand\\labelitemi{" + re_b.FindString(item) + "}\n")
+			item = re_b.ReplaceAllString(item, "")
+		}
+		env = "itemize"
+	case "n", "1.":
+		env = "enumerate"
+	case "d":
+		env = "description"
+	default:
+		env = "itemize"
+	}
+
+	// Implement Markdown's "four spaces rule" for auto-indentation.
+	this_indent_level := indent_level
+	re_4 := regexp.MustCompile(`^\s{4,}\-\s|^\s{4,}\d\.\s`) // At
+	// least four leading spaces followed by '- ' or '1. '
+	re_4 = regexp.MustCompile(`^\s{4,}(\-|1\.)`) // at least four spaces at the start of a line, followed by '-' or '1.'
+	pos := re_4.FindStringIndex(item)
+
+	if pos != nil {
+		// There are AT LEAST 4 spaces. If there are 8 or
+		// more, indent level  is two, and so on.
+		// 		info("pos[1] is: " + strconv.Itoa(pos[0]) )
+		if pos[1] > 4 && pos[1] < 9 {
+			this_indent_level = 1
+
+		} else if pos[1] > 8 && pos[1] < 13 {
+			this_indent_level = 2
+		} // Only allows three-level lists
+		// Trim the list marker, except for description item
+		debug("Adding list item: " + item)
+		if env != "description" {
+			item = item[pos[1]:len(item)]
+		}
+		debug("Item is now: " + item)
+
+	} else {
+		this_indent_level = 0
+	}
+
+	//info("Indent level is: " + strconv.Itoa(indent_level) )
+	// End Markdown-specific code
+
+	// OK, we know what type of environment the item belongs
+	// in. But is it the first item in a child environment?  Or
+	// resuming a parent environment?  And do we need to pop just
+	// one environment, or more?
+	if this_indent_level > indent_level {
+		//info("----> pushing " + env)
+		pushEnv(env, "  % auto-opened by auto-indenter")
+	} else if this_indent_level < indent_level {
+		// info("----> popping")
+		for this_indent_level < indent_level {
+			//info("This indent level: " + strconv.Itoa(this_indent_level) + "; previous indent level: " + strconv.Itoa(indent_level) )
+			popEnv(" % auto-closed from auto-indenter")
+			indent_level--
+		}
+	}
+
+	indent_level = this_indent_level
+
+	if inList {
+		pushEnv("item", item)
+	} else {
+		pushEnv(env, "  % auto-opened by list detector")
+		addItem(key, item) // recursion!
+	}
+}
+
+func addTeXlines(s string) {
+	if o.Indent < 0 {
+		o.Indent = 0
+	}
+	s = strings.Repeat(" ", o.Tab*o.Indent) + s
+	if SlidesOnly && NotesOnly {
+		error("Logic bomb on line number "+strconv.Itoa(line_number)+"!", "Notes Only AND Slides Only")
+	}
+	if SlidesOnly {
+		slidesTeXlines = append(slidesTeXlines, s)
+	} else if NotesOnly {
+		notesTeXlines = append(notesTeXlines, s)
+	} else {
+		notesTeXlines = append(notesTeXlines, s)
+		slidesTeXlines = append(slidesTeXlines, s)
+	}
+
+	re_nonMD := regexp.MustCompile(`\[\w+\]`)
+	if regexp.MustCompile(`^(\%)`).FindStringIndex(md_line) == nil && SlidesOnly == false && !md_skip {
+		// remove processing intructions, e.g. [no]
+		if re_nonMD.FindStringIndex == nil {
+			info("Found non-Markdown content:" + md_line)
+		}
+		// FIXME: for some reason, some lines end up repeated
+		// in the MD file.  The condition below is a dirty
+		// hack until I can find the real reason
+		mdl := len(markdownLines)
+		if mdl < 1 {
+			markdownLines = append(markdownLines, "\n")
+			mdl = len(markdownLines)
+		}
+
+		if markdownLines[mdl-1] != clozeMD(md_line)+"\n" {
+			if regexp.MustCompile(`^%`).FindStringIndex(md_line) == nil &&
+				regexp.MustCompile(`^p`).FindStringIndex(md_line) == nil {
+				md_line = regexp.MustCompile(`^\[no\]`).ReplaceAllString(md_line, "")
+				markdownLines = append(markdownLines, citations(resolveRefs(clozeMD(md_line), true), true)+"\n")
+			}
+		}
+	}
+}
+
+// Writes different LaTeX to the notes and slides, unless a notes-only or
+// slides-only block is open, in which case only that file is written.
+func addNotesSlides(notes string, slides string) {
+	if SlidesOnly {
+		addTeXlines(slides)
+	} else if NotesOnly {
+		addTeXlines(notes)
+	} else {
+		NotesOnly = true
+		addTeXlines(notes)
+		NotesOnly = false
+
+		SlidesOnly = true
+		addTeXlines(slides)
+		SlidesOnly = false
+	}
+}
+
+// Writes s to the Markdown file, and stops addTeXlines copying the current
+// source line there as well.
+func addMDlines(s string) {
+	md_skip = true
+	if !SlidesOnly {
+		markdownLines = append(markdownLines, s)
+	}
+}
+
+func pushEnv(env string, content string) {
+	lines := ""
+	if Debug > 2 {
+		info("Pushing: " + env)
+	}
+	switch env {
+	case "section":
+		if columns.Open {
+			error("Columns still open at line "+strconv.Itoa(line_number),
+				"closing them before the section")
+			endColumns()
+		}
+		popEnvs()
+		o.Indent = 0
+		tmp := false
+		hasStyle := false
+		frameStyle := ""
+
+		if strings.Contains(content, "[") { // Detect the frame style for Beamer slides
+			frameStyle = substr(content, "[", "]", false)
+			frameStyle = substr(content, "[", "]", true)
+			content = strings.TrimRight(content, frameStyle)
+			info("Frame contains styling: " + content + frameStyle)
+			hasStyle = true
+		} else {
+			if SlidesOnly {
+				frameStyle = "[noframenumbering]"
+				hasStyle = true
+			}
+		}
+		level := section_level
+		if level < 1 {
+			level = 1
+		}
+		if level > 3 {
+			level = 3
+		}
+		cmd := []string{"section", "subsection", "subsubsection"}[level-1]
+		mode := "frame"
+		if level > 1 {
+			mode = o.headingFrames[level-2]
+		}
+		content = strings.TrimSpace(content)
+		if !SlidesOnly {
+			tmp = NotesOnly
+			NotesOnly = true
+			label := ""
+			if section_label != "" {
+				label = "\\label{" + section_label + "}"
+			}
+			addTeXlines("\n\\" + cmd + "{" + content + "}" + label + "\n\\normalsize\n")
+			NotesOnly = tmp
+		}
+		if mode == "notes" && !SlidesOnly {
+			break
+		}
+
+		tmp = SlidesOnly
+		SlidesOnly = true
+		if mode == "subtitle" {
+			// The heading stays on the current frame
+			if section_label != "" {
+				addTeXlines("\\hypertarget{" + section_label + "}{}")
+			}
+			addTeXlines("\\framesubtitle{" + content + "}\n")
+			SlidesOnly = tmp
+			break
+		}
+		slidesCount++
+		addTeXlines("\\end{frame}\n\n")
+		if !tmp {
+			// For Beamer's navigation and outlines
+			addTeXlines("\\" + cmd + "{" + content + "}\n")
+		}
+		addTeXlines("\\begin{frame}")
+		frame_style = frameStyle // Continuation frames mustn't repeat the label
+		if section_label != "" {
+			// Label the frame, so that the slides can link to it
+			if hasStyle {
+				frameStyle = strings.TrimSuffix(frameStyle, "]") + ",label=" + section_label + "]"
+			} else {
+				frameStyle = "[label=" + section_label + "]"
+			}
+			hasStyle = true
+		}
+		if hasStyle {
+			addTeXlines(frameStyle)
+		}
+		addTeXlines("\\frametitle{" + content + "}\n")
+		SlidesOnly = tmp
+		frame_title = content
+	case "item":
+		lines = "\\item " + content + "\n"
+	case "itemize":
+		o.Indent++
+		lines = "\\begin{itemize}" + content + "\n"
+	case "enumerate":
+		o.Indent++
+		lines = "\\begin{enumerate}\n"
+	case "description":
+		o.Indent++
+		lines = "\\begin{description}\n"
+	case "tabular":
+		pushEnv("center", "")
+		lines = "\\begin{tabular}" + content + "\n\\toprule\n"
+	case "center":
+		lines = "\\begin{center}\n" + content + "\n"
+	case "quote":
+		lines = "\\begin{quote}\n" + content + "\n"
+	case "include":
+		lines = content + "\n"
+	}
+
+	if env == "item" {
+		o.Indent++
+		addTeXlines(lines)
+		o.Indent--
+	} else {
+		push(env, envStack)
+		if env != "section" {
+			addTeXlines(lines)
+		}
+	}
+}
+
+func popEnv(message string) {
+	env := envStack[0]
+	if Debug > 2 {
+		info("Popping: " + env)
+	}
+	s := ""
+	o.Indent--
+
+	if env == "tabular" {
+		in_table = true
+	} else {
+		in_table = false
+	}
+
+	switch env {
+	case "itemize":
+		s = "\\end{itemize}" + message + "\n"
+		if image_used {
+			addTeXlines("\\renewcommand\\labelitemi{-}\n")
+			image_used = false
+		}
+		o.Indent++
+	case "enumerate", "description", "tabular", "center", "quote":
+		s = ""
+		if in_table {
+			s = s + "\\bottomrule\n"
+			in_table = false
+		}
+		s = s + "\\end{" + env + "}" + message + "\n"
+		o.Indent++
+	default:
+		if Debug > 1 {
+			error("Unknown environment popped!", env)
+		}
+	}
+	pop(envStack)
+	if o.Indent < 0 {
+		o.Indent = 0
+	}
+	addTeXlines(s)
+	o.Indent--
+}
+
+func popEnvs() {
+	in_table = false
+	l := len(envStack)
+	if l > 0 {
+		for i := range envStack {
+			if len(envStack[i]) != 0 {
+				popEnv(" % auto-closed by popEnvs()")
+				i++
+			}
+		}
+	}
+}
+func makeCommon() string {
+	h := "\\hypersetup{\n" +
+		fmt.Sprintf("    pdftitle    = {%s: %s},\n",
+			o.CourseCode, o.CourseName) +
+		fmt.Sprintf("    pdfsubject  = {%s},    \n",
+			o.LectureTitle) +
+		fmt.Sprintf("    pdfkeywords = {%s  %s},\n",
+			o.CourseName, o.LectureTitle) +
+		fmt.Sprintf("    pdfauthor   = {%s, %s},\n",
+			o.Author1, o.Affiliation)
+
+	return (o.TeXPreambleCommon + bibPreamble() + h + o.TeXBeginDocument + clozePreamble())
+}
+
+// Loads the citation package chosen in the configuration, unless the
+// preamble already does, and the bibliography files it needs up front.
+// The citations themselves are always written as \citep and \citet,
+// which biblatex understands with its natbib option.
+func bibPreamble() string {
+	if !o.hasCitations {
+		return ""
+	}
+	s := ""
+	switch o.bibBackend {
+	case "natbib":
+		if !strings.Contains(o.TeXPreambleCommon, "{natbib}") {
+			opt := map[string]string{"authoryear": "round", "numeric": "numbers"}[o.citeStyle]
+			s += "\\usepackage[" + opt + "]{natbib}\n"
+		}
+	default:
+		if !strings.Contains(o.TeXPreambleCommon, "{biblatex}") {
+			s += "\\usepackage[backend=biber,style=" + o.citeStyle +
+				",natbib=true]{biblatex}\n"
+		}
+		for _, f := range o.bibFiles {
+			if !strings.Contains(o.TeXPreambleCommon, "{"+f+"}") {
+				s += "\\addbibresource{" + f + "}\n"
+			}
+		}
+	}
+	return s
+}
+
+// Adds a line to the foot of each frame with the works cited on it.
+func slideCiteFooters(body string) string {
+	re_cmd := regexp.MustCompile(`\\[A-Za-z]*cite[A-Za-z]*((?:\[[^\]]*\]|\{[^}]*\})+)`)
+	re_keys := regexp.MustCompile(`\{([^}]*)\}`)
+	frames := strings.Split(body, "\\end{frame}")
+	for i, f := range frames[:len(frames)-1] {
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, c := range re_cmd.FindAllStringSubmatch(f, -1) {
+			for _, k := range re_keys.FindAllStringSubmatch(c[1], -1) {
+				for _, key := range strings.Split(k[1], ",") {
+					key = strings.TrimSpace(key)
+					if key != "" && !seen[key] {
+						seen[key] = true
+						keys = append(keys, key)
+					}
+				}
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		// natbib can't print a whole entry in the text, so it gets the
+		// short form
+		cmd := "\\fullcite"
+		if o.bibBackend == "natbib" {
+			cmd = "\\citealp"
+		}
+		cites := []string{}
+		for _, k := range keys {
+			cites = append(cites, cmd+"{"+k+"}")
+		}
+		frames[i] = f + "\\vfill\n{\\tiny " + strings.Join(cites, "; ") + "\\par}\n"
+	}
+	return strings.Join(frames, "\\end{frame}")
+}
+
+// A frame listing the works cited in the slides, which Beamer breaks
+// over as many frames as it needs.
+func referencesFrame() string {
+	if !o.slideReferences || !o.hasCitations {
+		return ""
+	}
+	slidesCount++
+	refs := "\\printbibliography[heading=none]\n"
+	if o.bibBackend == "natbib" {
+		refs = bibCommand()
+	}
+	return "\n\\begin{frame}[allowframebreaks]\n\\frametitle{References}\n" +
+		"\\footnotesize\n" + refs + "\\end{frame}\n"
+}
+
+// The title and outline frames, if they are wanted.  They go between the
+// preamble, which opens a frame, and the slides, so the frame they leave
+// open is the one the slides go on with.  The outlines are made from the
+// sections in the slides (see pushEnv).
+func openingFrames() string {
+	s := ""
+	if o.slideTitle {
+		slidesCount++
+		s += "\\titlepage\n\\end{frame}\n\n\\begin{frame}"
+	}
+	if o.slideOutline {
+		slidesCount++
+		s += "\n\\frametitle{Outline}\n\\tableofcontents\n\\end{frame}\n\n\\begin{frame}"
+	}
+	if o.sectionOutlines {
+		slidesCount += strings.Count(strings.Join(slidesTeXlines, ""), "\\section{")
+	}
+	return s
+}
+
+// The command that prints the list of references at the end of the notes.
+func bibCommand() string {
+	if !o.hasCitations {
+		return ""
+	}
+	if o.bibBackend == "natbib" {
+		files := []string{}
+		for _, f := range o.bibFiles {
+			files = append(files, strings.TrimSuffix(f, ".bib"))
+		}
+		return "\n\\bibliographystyle{" + o.bibStyle + "}\n" +
+			"\\bibliography{" + strings.Join(files, ",") + "}\n"
+	}
+	return "\n\\printbibliography\n"
+}
+
+/**************************************************************************
+*
+* Write the notes file, then run pdflatex and clean up afterwards
+*
+**************************************************************************/
+func writeNotes(filename string, r chan bool) {
+	notesTitle := fmt.Sprintf("\\title{%s: %s\\\\%s}\n",
+		o.CourseCode, o.CourseName, o.LectureTitle)
+	notesAuthor := fmt.Sprintf("\\author{%s\\\\\\href{mailto:%s}{%s}",
+		o.Author1, o.Email1, o.Email1)
+	if o.Author2 != "" {
+		notesAuthor += fmt.Sprintf("\\\\  \\\\ %s\\\\ \\href{mailto:%s}{%s}", o.Author2, o.Email2, o.Email2)
+	}
+	notesAuthor += "}\n\n"
+	notesTop := o.notesTeXPreamble + notesTitle + notesAuthor +
+		"\\lfoot{" + o.CourseCode + " (" +
+		strings.TrimSpace(o.Date) + ")}\n" +
+		//		"\\cfoot{page \\thepage}\n" +
+		"\\rfoot{" + o.LectureTitle + "}\n"
+	if o.Date != "" {
+		notesTop += o.Date
+	}
+
+	notesTop += makeCommon() + o.notesTeXBeginDoc
+	if o.notesTOC {
+		notesTop += "\\tableofcontents\n"
+	}
+	if o.listOfFigures && figureCount > 0 && !placedLOF {
+		// Unless [lof] has put the list somewhere else
+		notesTop += "\\listoffigures\n"
+	}
+	popEnvs()
+	notesBottom := bibCommand()
+	notesBottom += "\\end{document}\n"
+	solutions := ""
+	if len(solutionsTeX) > 0 && o.solutions == "appendix" {
+		solutions = "\n\\section*{Solutions}\n\\addcontentsline{toc}{section}{Solutions}\n" +
+			strings.Join(solutionsTeX, "\n")
+	}
+	if len(solutionsTeX) > 0 && o.solutions == "separate" {
+		writeSolutions(filename, notesTop, notesBottom)
+	}
+	if hasClozes {
+		writeHandout(filename, notesTop, strings.Join(notesTeXlines, ""), notesBottom)
+	}
+	s := notesTop + strings.Join(notesTeXlines, "") + solutions + notesBottom
+
+	// The TeX code is done, now write it to a file and run the
+	// external tools on it
+	fs := strings.Split(filename, ".")
+
+	f := strings.ToLower(fs[0]) + "-notes" + audienceSuffix()
+	o.NotesFileName = f + ".tex"
+	writeOutput(o.NotesFileName, s)
+	if run_TeX {
+		info("====> Formatting notes with TeX")
+		res := runTeX(f, "notes")
+		if res {
+			flist := f + ".aux " + f + ".log " +
+				f + ".out " + f + ".run.xml " + f + ".bcf"
+			if o.hasCitations {
+				flist += f + ".bbl " + f + ".blg " + f + ".bcf"
+			}
+			cleanUp(flist)
+		} else {
+			info("Because of the previous error, I can't continue processing" +
+				" the notes.")
+			r <- false
+		}
+	} else {
+		debug("run_TeX is false?!?")
+	}
+	r <- true
+}
+
+/*******************************************************************************
+*
+* This function writes the LaTeX code for a Beamer presentation, then runs
+* pdflatex on it.
+*
+*******************************************************************************/
+func writeSlides(f string, r chan bool) {
+	beamerOptions := o.slidesTeXBeginDoc + fmt.Sprintf(
+		"\\title{%s}\n"+
+			"\\subtitle{%s %s}\n",
+		o.LectureTitle, o.CourseCode, o.CourseName)
+
+	if o.Author2 != "" {
+
+		beamerOptions += fmt.Sprintf("\\author{\n"+
+			"\\small\n"+
+			"\\texorpdfstring{\n"+
+			"  \\begin{columns}\n"+
+			"    \\column{0.45\\linewidth}\n      \\centering\n"+
+			"      %s\\newline\\href{%s}{%s}\n"+
+			"    \\column{0.45\\linewidth}\n      \\centering\n"+
+			"      %s\\newline\\href{%s}{%s}\n"+
+			"  \\end{columns}\n }{Nothing}\n}\n\n",
+			o.Author1, o.Email1, o.Email1,
+			o.Author2, o.Email2, o.Email2)
+	} else {
+		beamerOptions += fmt.Sprintf("\\author{%s\n\\newline$<$\\href{mailto:%s}{%s}$>$}\n\n",
+			o.Author1, o.Email1, o.Email1)
+	}
+	beamerOptions += fmt.Sprintf("\\institute{%s}\n", o.Affiliation)
+	beamerOptions += "\n\n"
+
+	s := beamerOptions
+
+	s += makeCommon()
+	if o.Date != "" {
+		s += o.Date
+	}
+	if figureCount > 0 {
+		s += "\\setbeamertemplate{caption}[numbered]\n"
+	}
+	if o.sectionOutlines {
+		s += "\\AtBeginSection[]{\n\\begin{frame}\n\\frametitle{Outline}\n" +
+			"\\tableofcontents[currentsection]\n\\end{frame}\n}\n"
+	}
+	s += o.slidesTeXPreamble + openingFrames()
+	popEnvs()
+	body := strings.Join(slidesTeXlines, "") + "\\end{frame}\n"
+	if o.slideCiteFooter && o.hasCitations {
+		body = slideCiteFooters(body)
+	}
+	body = slideFootnotes(body)
+	body = sectionNumbers(body)
+	// Sections are frames in the slides, and frames and exercises are
+	// linked to by name
+	body = regexp.MustCompile(`\\hyperref\[((?:sec|ex):[^\]]*)\]`).ReplaceAllString(body, "\\hyperlink{$1}")
+	body = fragileFrames(body)
+	s += body + referencesFrame() + "\\end{document}\n"
+
+	bits := strings.Split(f, ".")
+	f = strings.ToLower(bits[0])
+	f += "-slides" + audienceSuffix()
+	o.SlidesFileName = f + ".tex"
+	writeOutput(o.SlidesFileName, s)
+
+	if run_TeX {
+		info("====> Formatting slides with TeX")
+		res := runTeX(f, "slides")
+		if res {
+			flist := f + ".log " + f + ".aux " +
+				f + ".out " + f + ".nav " + f + ".snm " +
+				f + ".toc " + f + ".run.xml " + f + ".bcf"
+			if o.hasCitations {
+				flist += f + ".bbl " + f + ".blg " + f + ".bcf"
+			}
+			cleanUp(flist)
+		} else {
+			info("Because of the previous error, I can't continue processing" +
+				" the slides.")
+			r <- false
+		}
+	} else {
+		debug("run_TeX is false!?!")
+	}
+	r <- true
+}
+
+/*******************************************************************************
+*
+* This function writes the Markdown file then runs pandoc on it.
+*
+*******************************************************************************/
+
+func writeMD(filename string, r chan bool) {
+	mdYAML := "---\n"
+	notesTitle := fmt.Sprintf("title: %s %s (%s)\n",
+		o.CourseCode, o.CourseName, o.LectureTitle)
+	notesAuthor := fmt.Sprintf("author: %s", o.Author1)
+	if o.Author2 != "" {
+		notesAuthor += fmt.Sprintf("and %s", o.Author2)
+	}
+	notesTop := mdYAML + notesTitle + notesAuthor
+	if o.Date != "" {
+		d := regexp.MustCompile(`[^\{]+\{([^\}]+)\}`).ReplaceAllString(o.Date, "$1")
+		notesTop += "\ndate: " + d
+	}
+	if o.csl != "" {
+		// For anything Pandoc formats itself, e.g. with --citeproc
+		notesTop += "\ncsl: " + o.csl
+	}
+	notesTop += "\n\n---\n\n"
+
+	popEnvs()
+	notesBottom := referencesMD()
+	if len(solutionsMD) > 0 && o.solutions == "appendix" {
+		notesBottom = "\n# Solutions\n" + strings.Join(solutionsMD, "") + notesBottom
+	}
+	s := notesTop + strings.Join(markdownLines, "") + notesBottom
+	// The MD code is done, now write it to a file and run the
+	// external tools on it
+	fs := strings.Split(filename, ".")
+
+	f := strings.ToLower(fs[0]) + "-notes" + audienceSuffix()
+	f_m := f + ".md"
+	f_h := f + ".html"
+	//f_d := f + ".docx"
+	writeOutput(f_m, s)
+	args_h := []string{"--standalone", "--include-in-header=/home/john/Dropbox/Writing/snp/style.css", "--from=markdown+link_attributes+simple_tables+pipe_tables+definition_lists", "--output=" + f_h, f_m}
+	if o.htmlMath == "katex" {
+		// An offline copy of KaTeX, if there is one
+		if o.katex == "" {
+			warn("KaTeX isn't set, so the HTML will load KaTeX from the web")
+			args_h = append(args_h, "--katex")
+		} else {
+			args_h = append(args_h, "--katex="+o.katex)
+		}
+	} else {
+		args_h = append(args_h, "--mathml")
+	}
+	if o.notesTOC {
+		args_h = append(args_h, "--toc")
+	}
+	args_d := []string{f_h, "--output=" + f_h}
+
+	res := true
+	info("====> Formatting notes with pandoc")
+	//info("pandoc " + strings.Join(args_h, " ") )
+	res = runProg("pandoc", args_h)
+	if res {
+		info("pandoc " + strings.Join(args_d, " ") )
+		res = runProg("pandoc", args_d)
+	} else {
+		//fmt.Printf("====> Error running pandoc.\n")
+		res = false
+	}
+	if len(solutionsMD) > 0 && o.solutions == "separate" {
+		// The solutions, like the notes, in a file of their own
+		f_s := baseName(filename) + "-solutions" + audienceSuffix()
+		writeOutput(f_s+".md", notesTop+"# Solutions\n"+strings.Join(solutionsMD, ""))
+		args_s := []string{}
+		for _, a := range args_h {
+			switch a {
+			case f_m:
+				a = f_s + ".md"
+			case "--output=" + f_h:
+				a = "--output=" + f_s + ".html"
+			}
+			args_s = append(args_s, a)
+		}
+		info("====> Formatting solutions with pandoc")
+		res = runProg("pandoc", args_s) && res
+	}
+	r <- res
+}
+
+/*******************************************************************************
+*
+* This function calls the external tools to produce the PDF files.
+*
+*******************************************************************************/
+func runTeX(f string, ftype string) bool {
+	p := "pdflatex"
+	p = "xelatex"
+	a := []string{"-interaction=nonstopmode", f}
+	if o.codePackage == "minted" {
+		a = []string{"-shell-escape", "-interaction=nonstopmode", f} // minted runs Pygments
+	}
+	OK := false
+	if runProg(p, a) {
+		OK = true
+	} else {
+		if whichToKeep != ftype {
+			switch whichToKeep {
+			case "both":
+			case "notes":
+				whichToKeep = "both"
+			case "slides":
+				whichToKeep = "both"
+			default:
+				whichToKeep = ftype
+			}
+		}
+	}
+
+	if OK && o.hasCitations {
+		pb := "biber"
+		ab := []string{"--quiet", f}
+		if o.bibBackend == "natbib" {
+			pb = "bibtex"
+			ab = []string{f}
+		}
+		runProg(pb, ab)
+		runProg(p, a)
+		if o.bibBackend == "natbib" {
+			runProg(p, a) // natbib needs another pass for the references
+		}
+		cleanUp(f + ".bcf")
+	}
+
+	if ftype == "notes" { // Produce the 2up version of the notes
+		n := baseName(o.NotesFileName)
+		f = n + "-2up.tex"
+		t := o.nupTop + "{" + n + ".pdf}\n" + o.nupBottom
+		writeOutput(f, t)
+		a = []string{"-interaction=nonstopmode", f}
+		runProg(p, a)
+
+		flist := n + "-2up.tex " + n + "-2up.aux " + n + "-2up.log "
+		cleanUp(flist)
+	}
+	return true
+}
+
+/*******************************************************************************
+*                                                                              *
+* This function calls an external program with given arguments and a filename  *
+* to be processed                                                              *
+*                                                                              *
+*******************************************************************************/
+
+func runProg(p string, a []string) bool {
+	if Debug > 0 {
+		debug("\nRunning '" + p + "' '" + strings.Join(a, " ") + "'")
+	}
+
+	cmd := exec.Command(p, a...)
+	debug("====> About to exec " + p)
+	output, err := cmd.CombinedOutput()
+	debug("execing of " + p + " has completed\n")
+	if err != nil {
+		info(ErrorText + p + " did not complete successfully")
+		if Debug > 0 {
+			fmt.Println("Debug is:", Debug)
+		}
+		if Debug > 0 {
+			info("Parameter to runProg p (program) is: " + p)
+			info("Parameter to runProg a (arg) is: " + strings.Join(a, " "))
+			fmt.Println("error message is: ", err)
+			fmt.Println("error info:", fmt.Sprint(err)+"\nStd out: "+string(output))
+		}
+		return false
+	} else {
+		debug("Command '" + p + "' completed succesfully")
+		return true
+	}
+}
+
+func baseName(s string) string {
+	fs := strings.Split(s, ".")
+	return strings.ToLower(fs[0])
+}
+
+/*******************************************************************************
+*                                                                              *
+* This function removes a list of files given in a string with filenames       *
+* separated by spaces                                                          *
+*                                                                              *
+*******************************************************************************/
+func cleanUp(files string) {
+	flist := strings.Fields(files)
+	for i := 0; i < len(flist); i++ {
+		exists, _ := fileExists(flist[i], "")
+		if exists {
+			err := os.Remove(flist[i])
+
+			if err == nil {
+				if Debug > 2 {
+					info("Successfully removed " + files)
+				}
+			} else {
+				fmt.Println("Error removing files: ", err)
+			}
+		}
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* This function checks for the existence of a file                             *
+*                                                                              *
+*******************************************************************************/
+func fileExists(filename string, t string) (bool, uint64) {
+	graphicsTypes := []string{"", ".pdf", ".jpg", ".jpeg", ".png"}
+	found := false
+	f := filename
+	s, _ := os.Stat(f)
+
+	if t == "graphics" {
+		for i := range graphicsTypes {
+			f = filename + graphicsTypes[i]
+			stat, err := os.Stat(f)
+			if err == nil {
+				found = true
+				s = stat
+				break
+			}
+		}
+	} else {
+		stat, err := os.Stat(filename)
+		if err == nil {
+			found = true
+			s = stat
+		}
+	}
+
+	if found {
+		return true, uint64(s.Size())
+	} else {
+		return false, uint64(0)
+	}
+	return found, uint64(0)
+}
+
+func strElide(s string, l int) string {
+	end := math.Min(float64(len(s)), float64(l))
+	e := int(end)
+	return (s[0:e])
+}
+
+func readConf(filename string) bool {
+	o.Date = ""
+	o.hasCitations = false
+	o.Indent = 0
+	o.cacheDir = ".snp-cache"
+	o.notesTextWidth = 16 // cm
+	o.slidesTextWidth = 10.8
+	o.minDPI = 150
+	o.maxDPI = 300
+	o.imageBudget = 200 // KB
+	o.slideTableRows = 12
+	o.longTableRows = 30
+	o.bibFiles = []string{"/home/john/Dropbox/Writing/bib/all-refs.bib"}
+	o.bibBackend = "biblatex"
+	o.citeStyle = "authoryear"
+	o.bibStyle = "plainnat"
+	o.htmlMath = "mathml"
+	o.codePackage = "listings"
+	o.slideFootnotes = "frame"
+	o.headingFrames = [2]string{"frame", "frame"}
+	o.solutions = "appendix"
+	o.execTimeout = 10
+
+	if Debug > 0 {
+		info("Reading configuration from files in '" +
+			confLocation + "'")
+	}
+
+	readOptions(readInput(confLocation + filename))
+
+	TeXOptions := readInput(confLocation + "TeXOptions")
+	lines := ""
+	curKey := ""
+	prevKey := ""
+	for i := range TeXOptions {
+		tokens := strings.Split(TeXOptions[i], ":")
+		if len(tokens) > 1 {
+			curKey = strings.Trim(tokens[0], " ")
+			switch prevKey {
+			case "TeXBeginDocument":
+				o.TeXBeginDocument = lines
+			case "TeXPreambleCommon":
+				o.TeXPreambleCommon = lines
+			case "notesTeXPreamble":
+				o.notesTeXPreamble = lines
+			case "notesTeXBeginDocument":
+				o.notesTeXBeginDoc = lines
+			case "slidesTeXPreamble":
+				o.slidesTeXPreamble = lines
+			case "slidesTeXBeginDoc":
+				o.slidesTeXBeginDoc = lines
+			case "nupTop":
+				o.nupTop = strings.TrimSpace(lines)
+			case "nupBottom":
+				o.nupBottom = lines
+			}
+			lines = ""
+		} else {
+			prevKey = curKey
+			lines += tokens[0] + "\n"
+		}
+	}
+	return true
+}
+
+// Reads "key = value" lines into the options, up to the first blank line.
+func readOptions(contents []string) {
+	key := ""
+	val := ""
+
+	for i := range contents {
+		if contents[i] == "" {
+			break
+		}
+		keyval := strings.Split(contents[i], " = ")
+		key = strings.Trim(keyval[0], " ")
+		val = strings.Trim(keyval[1], " ")
+		// Handle sn comment lines
+		if strings.HasPrefix(key, "#") {
+			key = "#"
+		}
+
+		switch key {
+		case "Author1":
+			o.Author1 = val
+		case "Author2":
+			o.Author2 = val
+		case "Affiliation":
+			o.Affiliation = val
+		case "Email1":
+			o.Email1 = val
+		case "Email2":
+			o.Email2 = val
+		case "ErrorText":
+			ErrorText = val
+		case "Tab":
+			o.Tab, _ = strconv.Atoi(val)
+		case "Indent":
+			o.Indent, _ = strconv.Atoi(val)
+		case "bold":
+			o.bold = val
+		case "italic":
+			o.italic = val
+		case "NotesTextWidth", "SlidesTextWidth":
+			w, e := strconv.ParseFloat(val, 64)
+			if e != nil || w <= 0 {
+				error(key+" must be a width in cm, more than 0", val)
+				break
+			}
+			if key == "NotesTextWidth" {
+				o.notesTextWidth = w
+			} else {
+				o.slidesTextWidth = w
+			}
+		case "MinDPI", "MaxDPI", "ImageBudget":
+			n, e := strconv.Atoi(val)
+			if e != nil || n < 1 {
+				error(key+" must be a whole number, at least 1", val)
+				break
+			}
+			switch key {
+			case "MinDPI":
+				o.minDPI = n
+			case "MaxDPI":
+				o.maxDPI = n
+			default:
+				o.imageBudget = n
+			}
+		case "Downsample":
+			o.downsample = val == "true" || val == "yes"
+		case "CacheDir":
+			o.cacheDir = val
+		case "ListOfFigures":
+			o.listOfFigures = val == "true" || val == "yes"
+		case "Audience":
+			// e.g. student: student, handout
+			name, tags, _ := strings.Cut(val, ":")
+			name = strings.TrimSpace(name)
+			if o.audienceTags == nil {
+				o.audienceTags = map[string][]string{}
+			}
+			for _, t := range strings.Split(tags, ",") {
+				o.audienceTags[name] = append(o.audienceTags[name], strings.TrimSpace(t))
+			}
+		case "NotesTOC":
+			o.notesTOC = val == "true" || val == "yes"
+		case "SlideTitle":
+			o.slideTitle = val == "true" || val == "yes"
+		case "SlideOutline":
+			o.slideOutline = val == "true" || val == "yes"
+		case "SectionOutlines":
+			o.sectionOutlines = val == "true" || val == "yes"
+		case "SlideTableRows", "LongTableRows":
+			n, e := strconv.Atoi(val)
+			if e != nil || n < 0 {
+				error(key+" must be a whole number of rows, or 0 for no limit", val)
+				break
+			}
+			if key == "SlideTableRows" {
+				o.slideTableRows = n
+			} else {
+				o.longTableRows = n
+			}
+		case "Bibliography":
+			o.bibFiles = strings.Split(val, ",")
+			for i := range o.bibFiles {
+				o.bibFiles[i] = strings.TrimSpace(o.bibFiles[i])
+			}
+		case "CSL":
+			o.csl = val
+		case "BibBackend":
+			if val != "biblatex" && val != "natbib" {
+				error("BibBackend must be biblatex or natbib", val)
+				break
+			}
+			o.bibBackend = val
+		case "CitationStyle":
+			if val != "authoryear" && val != "numeric" {
+				error("CitationStyle must be authoryear or numeric", val)
+				break
+			}
+			o.citeStyle = val
+		case "BibStyle":
+			o.bibStyle = val
+		case "HTMLMath":
+			if val != "mathml" && val != "katex" {
+				error("HTMLMath must be mathml or katex", val)
+				break
+			}
+			o.htmlMath = val
+		case "KaTeX":
+			o.katex = val
+		case "PlantUMLJar":
+			o.plantUML = val
+		case "ExecTimeout":
+			n, e := strconv.Atoi(val)
+			if e != nil || n < 1 {
+				error("ExecTimeout must be a whole number of seconds, at least 1", val)
+				break
+			}
+			o.execTimeout = n
+		case "CodePackage":
+			if val != "listings" && val != "minted" {
+				error("CodePackage must be listings or minted", val)
+				break
+			}
+			o.codePackage = val
+		case "SlideCiteFooter":
+			o.slideCiteFooter = val == "true" || val == "yes"
+		case "Subsections", "Subsubsections":
+			if val != "frame" && val != "subtitle" && val != "notes" {
+				error(key+" must be frame, subtitle or notes", val)
+				break
+			}
+			o.headingFrames[map[string]int{"Subsections": 0, "Subsubsections": 1}[key]] = val
+		case "ClozeKey":
+			o.clozeKey = val == "true" || val == "yes"
+		case "Solutions":
+			if val != "appendix" && val != "separate" && val != "none" {
+				error("Solutions must be appendix, separate or none", val)
+				break
+			}
+			o.solutions = val
+		case "SlideFootnotes":
+			if val != "frame" && val != "notes" {
+				error("SlideFootnotes must be frame or notes", val)
+				break
+			}
+			o.slideFootnotes = val
+		case "SlideReferences":
+			o.slideReferences = val == "true" || val == "yes"
+		case "#":
+		default:
+			error("No match for key in snp.ini! Key is: "+key, "")
+		}
+	}
+}
+
+// Reads the optional snp.ini in the source file's directory, for settings
+// that apply to a whole course, then the lecture's own .ini file (e.g.
+// week3.ini for week3.sn).  Both override the global configuration.
+func readLocalConf(source string) {
+	for _, f := range []string{filepath.Join(filepath.Dir(source), confFile),
+		strings.TrimSuffix(source, filepath.Ext(source)) + ".ini"} {
+		if abs, _ := filepath.Abs(f); abs == filepath.Clean(confLocation+confFile) {
+			continue
+		}
+		if found, _ := fileExists(f, ""); found {
+			debug("Reading configuration from " + f)
+			readOptions(readInput(f))
+		}
+	}
+}
+
+/************************************************************************
+* Returns string between two delimiters, optionally including the       *
+* delimeters themselves.  If the end string is "", returns from the     *
+* start delimiter to the end of the input string                        *
+************************************************************************/
+func substr(s, start, end string, id bool) string {
+	x := strings.Index(s, start)
+	y := 0
+
+	if end == "" {
+		y = len(s)
+	} else {
+		y = strings.Index(s, end)
+	}
+	var ss string
+
+	if id { // id = "include delimiters"
+		ss = s[x : y+1]
+	} else {
+		ss = s[x+1 : y]
+	}
+	if Debug > 2 {
+		info("Substring of '" + s + "' delimited by '" +
+			start + "' and '" + end + "' is '" + ss + "'")
+	}
+	return strings.TrimSpace(ss)
+}
+
+func tc(part, pars string) {
+	// The old two-column layout, now a thin wrapper around the columns
+	// construct. The minipage height is no longer needed, because
+	// columns size themselves to their content.
+	switch part {
+	case "begin":
+		parv := strings.Fields(pars) // Width of left column + minipage height
+		if len(parv) == 0 {
+			abort("tcb on line " + strconv.Itoa(line_number) +
+				" needs the width of the left column")
+		}
+		if len(parv) > 1 {
+			debug("Ignoring tcb height (" + parv[1] + "): columns size themselves")
+		}
+		w, e := strconv.ParseFloat(parv[0], 64)
+		if e != nil || w <= 0 || w >= 1 {
+			abort("tcb on line " + strconv.Itoa(line_number) +
+				": left column width must be a fraction between 0 and 1, not '" +
+				parv[0] + "'")
+		}
+		beginColumns(parv[0] + " " + strconv.FormatFloat(1-w, 'f', 2, 64))
+	case "split":
+		splitColumns()
+	case "end":
+		endColumns()
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* Multi-column layouts.  The source looks like this:                           *
+*                                                                              *
+*     cb 0.3 0.7 t       (widths as fractions, optional alignment t, c or b)   *
+*     ... first column ...                                                     *
+*     cs                                                                       *
+*     ... second column ...                                                    *
+*     ce                                                                       *
+*                                                                              *
+* "cb 3" gives three columns of equal width.  Columns become Beamer columns on *
+* the slides, minipages in the notes and a CSS grid in the HTML.               *
+*                                                                              *
+*******************************************************************************/
+const colGap = 0.04 // Fraction of the line width left between columns
+
+func parseColumns(pars string) (Columns, string) {
+	c := Columns{Align: "t"}
+	for _, p := range strings.Fields(pars) {
+		switch p {
+		case "t", "top":
+			c.Align = "t"
+			continue
+		case "c", "center", "centre", "middle":
+			c.Align = "c"
+			continue
+		case "b", "bottom":
+			c.Align = "b"
+			continue
+		}
+		w, e := strconv.ParseFloat(p, 64)
+		if e != nil {
+			return c, "'" + p + "' is neither a column width nor an alignment"
+		}
+		if w <= 0 {
+			return c, "column widths must be positive, not " + p
+		}
+		c.Widths = appendAny(c.Widths, w)
+	}
+
+	if len(c.Widths) == 0 {
+		return c, "no column widths given"
+	}
+
+	// A single whole number is a count of equal columns
+	if n := c.Widths[0]; len(c.Widths) == 1 && n >= 2 && n == math.Trunc(n) {
+		c.Widths = make([]float64, int(n))
+		for i := range c.Widths {
+			c.Widths[i] = 1 / n
+		}
+	}
+	if len(c.Widths) < 2 {
+		return c, "at least two columns are needed"
+	}
+
+	sum := 0.0
+	for _, w := range c.Widths {
+		sum += w
+	}
+	if sum > 1.001 {
+		return c, "column widths add up to " +
+			strconv.FormatFloat(sum, 'f', 2, 64) + ", more than the line width"
+	}
+	return c, ""
+}
+
+// Returns the width of column i in LaTeX, leaving room for the gaps between
+// columns.
+func columnWidth(i int) string {
+	scale := 1 - colGap*float64(len(columns.Widths)-1)
+	return strconv.FormatFloat(columns.Widths[i]*scale, 'f', 3, 64)
+}
+
+func beginColumns(pars string) {
+	if columns.Open {
+		abort("Columns cannot be nested (line " + strconv.Itoa(line_number) + ")")
+	}
+	c, msg := parseColumns(pars)
+	if msg != "" {
+		abort("Bad columns on line " + strconv.Itoa(line_number) + ": " + msg)
+	}
+	columns = c
+	columns.Open = true
+	columns.Col = 0
+
+	grid := ""
+	for _, w := range columns.Widths {
+		grid += " " + strconv.FormatFloat(w*100, 'f', 0, 64) + "fr"
+	}
+	htmlAlign := map[string]string{"t": "start", "c": "center", "b": "end"}
+	addMDlines("\n<div class=\"columns\" style=\"display: grid;" +
+		" grid-template-columns:" + grid + ";" +
+		" align-items: " + htmlAlign[columns.Align] + "; column-gap: 2em;\">\n" +
+		"<div class=\"column\">\n\n")
+
+	addNotesSlides("\\par\\noindent\n"+
+		"\\begin{minipage}["+columns.Align+"]{"+columnWidth(0)+"\\linewidth}\n",
+		"\\begin{columns}["+columns.Align+"]\n"+
+			"\\begin{column}{"+columnWidth(0)+"\\textwidth}\n")
+}
+
+func splitColumns() {
+	md_skip = true
+	if !columns.Open {
+		abort("cs on line " + strconv.Itoa(line_number) + " is not inside columns")
+	}
+	popEnvs()
+	columns.Col++
+	if columns.Col >= len(columns.Widths) {
+		abort("Too many columns on line " + strconv.Itoa(line_number) +
+			": only " + strconv.Itoa(len(columns.Widths)) + " were declared")
+	}
+	addMDlines("\n</div>\n<div class=\"column\">\n\n")
+	addNotesSlides("\\end{minipage}\\hfill\n"+
+		"\\begin{minipage}["+columns.Align+"]{"+columnWidth(columns.Col)+"\\linewidth}\n",
+		"\\end{column}\n"+
+			"\\begin{column}{"+columnWidth(columns.Col)+"\\textwidth}\n")
+}
+
+func endColumns() {
+	md_skip = true
+	if !columns.Open {
+		abort("ce on line " + strconv.Itoa(line_number) + " is not inside columns")
+	}
+	popEnvs()
+	if columns.Col < len(columns.Widths)-1 {
+		warn("only " + strconv.Itoa(columns.Col+1) + " of " +
+			strconv.Itoa(len(columns.Widths)) +
+			" columns were used before line " + strconv.Itoa(line_number))
+	}
+	columns.Open = false
+	addMDlines("\n</div>\n</div>\n\n")
+	addNotesSlides("\\end{minipage}\n\\par\n",
+		"\\end{column}\n\\end{columns}\n")
+}
+
+/*******************************************************************************
+*                                                                              *
+* A small BibTeX/BibLaTeX reader, so that citation keys can be checked as the  *
+* source is read, rather than turning up as "??" in the PDF after a full       *
+* build.  It understands @comment, @preamble and @string well enough to skip   *
+* them, and entries delimited by braces or parentheses.                        *
+*                                                                              *
+*******************************************************************************/
+
+type BibEntry struct {
+	Type   string
+	Key    string
+	Fields map[string]string
+	File   string
+	Line   int
+}
+
+var bibEntries map[string]BibEntry // nil until the bibliography is loaded
+var citedKeys = map[string]bool{}
+var listUnused bool
+
+func loadBibliography() {
+	bibEntries = make(map[string]BibEntry)
+	for _, f := range o.bibFiles {
+		content, e := ioutil.ReadFile(f)
+		if e != nil {
+			warn("can't read the bibliography " + f + ", so its keys can't be checked")
+			continue
+		}
+		for _, b := range parseBib(string(content), f) {
+			if d, dup := bibEntries[b.Key]; dup {
+				warn("the key " + b.Key + " is in " + d.File + " (line " +
+					strconv.Itoa(d.Line) + ") and " + f + " (line " +
+					strconv.Itoa(b.Line) + ")")
+			}
+			bibEntries[b.Key] = b
+		}
+	}
+	debug("Read " + strconv.Itoa(len(bibEntries)) + " bibliography entries")
+}
+
+func parseBib(s string, file string) []BibEntry {
+	entries := []BibEntry{}
+	re_entry := regexp.MustCompile(`@(\w+)\s*[{(]`)
+	pos := 0
+	for {
+		m := re_entry.FindStringSubmatchIndex(s[pos:])
+		if m == nil {
+			break
+		}
+		start := pos + m[0]
+		line := 1 + strings.Count(s[:start], "\n")
+		typ := strings.ToLower(s[pos+m[2] : pos+m[3]])
+		open := pos + m[1] - 1
+		end := matchBrace(s, open)
+		if end < 0 {
+			warn("unterminated @" + typ + " in " + file + " (line " +
+				strconv.Itoa(line) + ")")
+			pos = open + 1
+			continue
+		}
+		pos = end + 1
+		if typ == "comment" || typ == "preamble" || typ == "string" {
+			continue
+		}
+		body := s[open+1 : end]
+		k := strings.Index(body, ",")
+		if k < 0 {
+			k = len(body)
+		}
+		entries = appendAny(entries, BibEntry{
+			Type:   typ,
+			Key:    strings.TrimSpace(body[:k]),
+			Fields: bibFields(body[k:]),
+			File:   file,
+			Line:   line,
+		})
+	}
+	return entries
+}
+
+// Returns the index of the brace or parenthesis that closes the one at
+// s[open], or -1 if it isn't closed.  Escaped braces, e.g. \{, don't count.
+func matchBrace(s string, open int) int {
+	depth := 0
+	for i := open + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 && s[open] == '{' {
+				return i
+			}
+			depth--
+		case ')':
+			if depth == 0 && s[open] == '(' {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Reads the name = value pairs of an entry.  Values lose their outer
+// braces or quotes, but are otherwise left as they are.
+func bibFields(s string) map[string]string {
+	fields := map[string]string{}
+	re_name := regexp.MustCompile(`^[\s,]*([\w\-:.]+)\s*=\s*`)
+	for {
+		m := re_name.FindStringSubmatchIndex(s)
+		if m == nil {
+			break
+		}
+		name := strings.ToLower(s[m[2]:m[3]])
+		s = s[m[1]:]
+		depth, quoted, i := 0, false, 0
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			} else if c == '"' && depth == 0 {
+				quoted = !quoted
+			} else if c == ',' && depth == 0 && !quoted {
+				break
+			}
+		}
+		v := strings.TrimSpace(s[:i])
+		if len(v) > 1 && (v[0] == '{' && v[len(v)-1] == '}' ||
+			v[0] == '"' && v[len(v)-1] == '"') {
+			v = v[1 : len(v)-1]
+		}
+		fields[name] = v
+		s = s[i:]
+	}
+	return fields
+}
+
+// Reports citation keys that aren't in the bibliography, with any keys
+// that look like what was meant.
+func checkCitations(keys []string) {
+	if bibEntries == nil {
+		loadBibliography()
+	}
+	for _, k := range keys {
+		citedKeys[k] = true
+		if _, ok := bibEntries[k]; ok || len(bibEntries) == 0 {
+			continue
+		}
+		hint := "not in " + strings.Join(o.bibFiles, ", ")
+		if s := suggestKeys(k); len(s) > 0 {
+			hint = "did you mean " + strings.Join(s, " or ") + "?"
+		}
+		error("Unknown citation key @"+k+" on line "+strconv.Itoa(line_number), hint)
+	}
+}
+
+// The (up to three) keys closest to a mistyped one.
+func suggestKeys(key string) []string {
+	type near struct {
+		key  string
+		dist int
+	}
+	limit := int(math.Max(2, float64(len(key))/4))
+	found := []near{}
+	for k := range bibEntries {
+		d := editDistance(strings.ToLower(key), strings.ToLower(k))
+		if d <= limit {
+			found = appendAny(found, near{k, d})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].dist != found[j].dist {
+			return found[i].dist < found[j].dist
+		}
+		return found[i].key < found[j].key
+	})
+	s := []string{}
+	for i := 0; i < len(found) && i < 3; i++ {
+		s = append(s, "@"+found[i].key)
+	}
+	return s
+}
+
+// The Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = int(math.Min(float64(prev[j]+1),
+				math.Min(float64(cur[j-1]+1), float64(prev[j-1]+cost))))
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// Lists the bibliography entries that the source never cites (-u).
+func reportUnused() {
+	if bibEntries == nil {
+		loadBibliography()
+	}
+	unused := []string{}
+	for k := range bibEntries {
+		if !citedKeys[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	info(strconv.Itoa(len(unused)) + " of " + strconv.Itoa(len(bibEntries)) +
+		" bibliography entries are not cited:")
+	for _, k := range unused {
+		info("   " + k + " (" + bibEntries[k].File + ", line " +
+			strconv.Itoa(bibEntries[k].Line) + ")")
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* Citations, in Pandoc's syntax: [see @smith2020, p. 3; @jones2019] in         *
+* parentheses, or @smith2020 [p. 3] in the text.  A minus before the key       *
+* (-@smith2020) leaves out the author.  For TeX they become \citep and \citet; *
+* for the Markdown file they are formatted here, from the bibliography, in the *
+* same style biblatex uses in the PDFs, with a list of references at the end.  *
+*                                                                              *
+*******************************************************************************/
+
+type Citation struct {
+	Key      string
+	Prefix   string
+	Suffix   string
+	NoAuthor bool
+}
+
+const citeKey = `[\w][\w:.#$%&+?<>~/\-]*[\w]|[\w]`
+
+var re_cite_group = regexp.MustCompile(`\[([^\[\]]*@[^\[\]]*)\](\()?`)
+var re_cite_part = regexp.MustCompile(`^\s*(.*?)(-?)@(` + citeKey + `)(.*)$`)
+var re_cite_text = regexp.MustCompile(`(^|[^\w\[@\-])@(` + citeKey + `)(\s*\[([^\[\]@]*)\])?`)
+
+// Reads the citations in a bracketed group, e.g. "see @smith2020, p. 3;
+// @jones2019", or returns nil if it isn't one (an email address, say).
+func parseCiteGroup(g string) []Citation {
+	cites := []Citation{}
+	for _, part := range strings.Split(g, ";") {
+		m := re_cite_part.FindStringSubmatch(part)
+		if m == nil || isRef(m[3]) {
+			return nil
+		}
+		cites = appendAny(cites, Citation{
+			Key:      m[3],
+			Prefix:   strings.TrimSpace(m[1]),
+			Suffix:   strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(m[4]), ",")),
+			NoAuthor: m[2] == "-",
+		})
+	}
+	return cites
+}
+
+// Whether a key is really a cross-reference, such as fig:dog.
+func isRef(key string) bool {
+	if k := strings.Index(key, ":"); k > 0 {
+		_, ok := refKinds[key[:k]]
+		return ok
+	}
+	return false
+}
+
+// Replaces the citations in a line with TeX, or with formatted text for
+// the Markdown file.  During the pre-pass, it only notes the keys, so the
+// references can be numbered before any are written.
+func citations(line string, md bool) string {
+	line = re_cite_group.ReplaceAllStringFunc(line, func(g string) string {
+		m := re_cite_group.FindStringSubmatch(g)
+		cites := parseCiteGroup(m[1])
+		if m[2] != "" || cites == nil {
+			return g // A link, or not a citation at all
+		}
+		return citeGroup(cites, md)
+	})
+	return re_cite_text.ReplaceAllStringFunc(line, func(t string) string {
+		m := re_cite_text.FindStringSubmatch(t)
+		if isRef(m[2]) {
+			return t
+		}
+		c := Citation{Key: m[2], Suffix: strings.TrimSpace(m[4])}
+		return m[1] + citeText(c, md)
+	})
+}
+
+func noteCitations(cites []Citation) {
+	keys := []string{}
+	for _, c := range cites {
+		keys = append(keys, c.Key)
+	}
+	if collecting {
+		for _, k := range keys {
+			citedKeys[k] = true
+		}
+		return
+	}
+	o.hasCitations = true
+	checkCitations(keys)
+}
+
+// A parenthetical citation
+func citeGroup(cites []Citation, md bool) string {
+	noteCitations(cites)
+	if collecting {
+		return ""
+	}
+	if md {
+		parts := []string{}
+		for _, c := range cites {
+			s := c.Prefix + " "
+			if o.citeStyle == "numeric" {
+				s += citeLink(c.Key, citeNumber(c.Key))
+			} else {
+				if !c.NoAuthor {
+					s += citeAuthor(c.Key) + " "
+				}
+				s += citeLink(c.Key, citeYear(c.Key))
+			}
+			if c.Suffix != "" {
+				s += ", " + c.Suffix
+			}
+			parts = append(parts, strings.TrimSpace(s))
+		}
+		if o.citeStyle == "numeric" {
+			return "\\[" + strings.Join(parts, "; ") + "\\]"
+		}
+		return "(" + strings.Join(parts, "; ") + ")"
+	}
+
+	if len(cites) == 1 {
+		cmd := "\\citep"
+		if cites[0].NoAuthor {
+			cmd = "\\citeyearpar"
+		}
+		return cmd + citeNotes(cites[0].Prefix, cites[0].Suffix) + "{" + cites[0].Key + "}"
+	}
+	// \citep takes one prenote and one postnote, for the whole list
+	simple := true
+	keys := []string{}
+	for i, c := range cites {
+		keys = append(keys, c.Key)
+		if c.NoAuthor || (c.Prefix != "" && i > 0) || (c.Suffix != "" && i < len(cites)-1) {
+			simple = false
+		}
+	}
+	if simple {
+		return "\\citep" + citeNotes(cites[0].Prefix, cites[len(cites)-1].Suffix) +
+			"{" + strings.Join(keys, ",") + "}"
+	}
+	if o.bibBackend == "natbib" {
+		parts := []string{}
+		for _, c := range cites {
+			cmd := "\\citealp"
+			if c.NoAuthor {
+				cmd = "\\citeyear"
+			}
+			parts = append(parts, cmd+citeNotes(c.Prefix, c.Suffix)+"{"+c.Key+"}")
+		}
+		if o.citeStyle == "numeric" {
+			return "[" + strings.Join(parts, "; ") + "]"
+		}
+		return "(" + strings.Join(parts, "; ") + ")"
+	}
+	s := "\\parencites"
+	for _, c := range cites {
+		s += "[" + c.Prefix + "][" + c.Suffix + "]{" + c.Key + "}"
+	}
+	return s
+}
+
+// A citation in the text, e.g. Smith (2020, p. 3)
+func citeText(c Citation, md bool) string {
+	noteCitations([]Citation{c})
+	if collecting {
+		return ""
+	}
+	if !md {
+		return "\\citet" + citeNotes("", c.Suffix) + "{" + c.Key + "}"
+	}
+	if o.citeStyle == "numeric" {
+		s := citeLink(c.Key, citeNumber(c.Key))
+		if c.Suffix != "" {
+			s += ", " + c.Suffix
+		}
+		return citeAuthor(c.Key) + " \\[" + s + "\\]"
+	}
+	s := citeLink(c.Key, citeYear(c.Key))
+	if c.Suffix != "" {
+		s += ", " + c.Suffix
+	}
+	return citeAuthor(c.Key) + " (" + s + ")"
+}
+
+// The optional arguments of \citep and friends
+func citeNotes(prefix, suffix string) string {
+	switch {
+	case prefix != "":
+		return "[" + prefix + "][" + suffix + "]"
+	case suffix != "":
+		return "[" + suffix + "]"
+	}
+	return ""
+}
+
+func citeLink(key, text string) string {
+	if _, ok := bibEntries[key]; !ok {
+		return text
+	}
+	return "[" + text + "](#ref-" + key + ")"
+}
+
+// The short form of an entry's authors: Smith, Smith and Jones, or Smith
+// et al.
+func citeAuthor(key string) string {
+	e, ok := bibEntries[key]
+	if !ok {
+		return "**" + key + "?**"
+	}
+	names := bibNames(e)
+	switch len(names) {
+	case 0:
+		return "*" + bibText(e.Fields["title"]) + "*"
+	case 1:
+		return names[0][0]
+	case 2:
+		return names[0][0] + " and " + names[1][0]
+	}
+	return names[0][0] + " et al."
+}
+
+func citeYear(key string) string {
+	e, ok := bibEntries[key]
+	if !ok {
+		return "n.d."
+	}
+	if y := e.Fields["year"]; y != "" {
+		return bibText(y)
+	}
+	if d := e.Fields["date"]; len(d) >= 4 {
+		return d[:4]
+	}
+	return "n.d."
+}
+
+var citeNumbers map[string]int
+
+// The number of a reference in the numeric style.  As in biblatex, the
+// references are numbered in the order they are listed.
+func citeNumber(key string) string {
+	if citeNumbers == nil {
+		citeNumbers = map[string]int{}
+		for i, k := range citedEntries() {
+			citeNumbers[k] = i + 1
+		}
+	}
+	if n, ok := citeNumbers[key]; ok {
+		return strconv.Itoa(n)
+	}
+	return "??"
+}
+
+// The keys of the cited entries, in the order of the reference list: by
+// name, year and title (biblatex's nyt), or name, title and year for the
+// numeric style (nty).
+func citedEntries() []string {
+	if bibEntries == nil {
+		loadBibliography()
+	}
+	keys := []string{}
+	for k := range citedKeys {
+		if _, ok := bibEntries[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	sortKey := func(k string) string {
+		e := bibEntries[k]
+		y, t := citeYear(k), bibText(e.Fields["title"])
+		name := t // biblatex sorts anonymous works by title
+		if names := bibNames(e); len(names) > 0 {
+			name = ""
+			for _, n := range names {
+				name += n[0] + " " + n[1] + " "
+			}
+		}
+		if o.citeStyle == "numeric" {
+			return strings.ToLower(name + "\x00" + t + "\x00" + y)
+		}
+		return strings.ToLower(name + "\x00" + y + "\x00" + t)
+	}
+	sort.Slice(keys, func(i, j int) bool { return sortKey(keys[i]) < sortKey(keys[j]) })
+	return keys
+}
+
+// An entry's authors (or editors) as [family, given] pairs.
+func bibNames(e BibEntry) [][2]string {
+	field := e.Fields["author"]
+	if field == "" {
+		field = e.Fields["editor"]
+	}
+	names := [][2]string{}
+	for _, n := range splitTopLevel(field, " and ") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if parts := splitTopLevel(n, ","); len(parts) > 1 {
+			names = appendAny(names, [2]string{bibText(parts[0]), bibText(strings.Join(parts[1:], ","))})
+			continue
+		}
+		words := splitTopLevel(n, " ")
+		last := len(words) - 1
+		names = appendAny(names, [2]string{bibText(words[last]), bibText(strings.Join(words[:last], " "))})
+	}
+	return names
+}
+
+// Splits a BibTeX value at a separator that isn't inside braces.
+func splitTopLevel(s, sep string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		default:
+			if depth == 0 && strings.HasPrefix(s[i:], sep) {
+				parts = append(parts, s[start:i])
+				start = i + len(sep)
+				i += len(sep) - 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Makes a BibTeX value readable as Markdown.
+func bibText(s string) string {
+	s = regexp.MustCompile(`\\(emph|textit)\{([^{}]*)\}`).ReplaceAllString(s, "*$2*")
+	s = regexp.MustCompile(`\\textbf\{([^{}]*)\}`).ReplaceAllString(s, "**$1**")
+	s = strings.NewReplacer("---", "—", "--", "–", "\\&", "&", "\\%", "%",
+		"\\$", "$", "\\_", "_", "~", " ", "{", "", "}", "").Replace(s)
+	s = regexp.MustCompile(`\\[a-zA-Z]+\s*`).ReplaceAllString(s, "")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// The list of references at the end of the Markdown notes, in the style
+// of biblatex's standard styles.
+func referencesMD() string {
+	keys := citedEntries()
+	if len(keys) == 0 {
+		return ""
+	}
+	s := "\n# References\n\n"
+	for i, k := range keys {
+		s += "::: {#ref-" + k + " .reference}\n"
+		if o.citeStyle == "numeric" {
+			s += "\\[" + strconv.Itoa(i+1) + "\\] "
+		}
+		s += referenceMD(bibEntries[k]) + "\n:::\n\n"
+	}
+	return s
+}
+
+func referenceMD(e BibEntry) string {
+	f := func(name string) string { return bibText(e.Fields[name]) }
+	numeric := o.citeStyle == "numeric"
+
+	authors := []string{}
+	for i, n := range bibNames(e) {
+		if n[1] == "" {
+			authors = append(authors, n[0])
+		} else if i == 0 {
+			authors = append(authors, n[0]+", "+n[1])
+		} else {
+			authors = append(authors, n[1]+" "+n[0])
+		}
+	}
+	s := ""
+	if len(authors) > 0 {
+		s = strings.Join(authors[:len(authors)-1], ", ")
+		if len(authors) > 1 {
+			s += " and "
+		}
+		s += authors[len(authors)-1]
+		if e.Fields["author"] == "" {
+			s += map[bool]string{true: ", eds.", false: ", ed."}[len(authors) > 1]
+		}
+	}
+	year := citeYear(e.Key)
+	title := f("title")
+	if s == "" {
+		// Anonymous works start with the title
+		s, title = "*"+title+"*", ""
+		if e.Type == "article" || strings.HasPrefix(e.Type, "in") {
+			s = "“" + f("title") + "”"
+		}
+	}
+	if !numeric {
+		s += " (" + year + ")"
+	}
+	if !strings.HasSuffix(s, ".") {
+		s += "."
+	}
+	s += " "
+	quoted := func(t string) string {
+		if t == "" {
+			return ""
+		}
+		return "“" + t + "”. "
+	}
+	italic := func(t string) string {
+		if t == "" {
+			return ""
+		}
+		return "*" + t + "*. "
+	}
+
+	parts := []string{}
+	add := func(p string) {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	pages := ""
+	if f("pages") != "" {
+		pages = "pp. " + f("pages")
+	}
+	journal := f("journaltitle")
+	if journal == "" {
+		journal = f("journal")
+	}
+	place := f("location")
+	if place == "" {
+		place = f("address")
+	}
+	publisher := f("publisher")
+	if place != "" && publisher != "" {
+		publisher = place + ": " + publisher
+	} else if place != "" {
+		publisher = place
+	}
+
+	switch e.Type {
+	case "article":
+		s += quoted(title)
+		j := ""
+		if journal != "" {
+			j = "In: *" + journal + "*"
+		}
+		if f("volume") != "" {
+			j += " " + f("volume")
+			if f("number") != "" {
+				j += "." + f("number")
+			}
+		}
+		if numeric && j != "" {
+			j += " (" + year + ")"
+		} else if numeric {
+			j = year
+		}
+		add(strings.TrimSpace(j))
+		add(pages)
+	case "incollection", "inproceedings", "inbook":
+		s += quoted(title)
+		if f("booktitle") != "" {
+			add("In: *" + f("booktitle") + "*")
+		}
+		add(publisher)
+		if numeric {
+			add(year)
+		}
+		add(pages)
+	default:
+		s += italic(title)
+		add(publisher)
+		add(f("howpublished"))
+		if numeric {
+			add(year)
+		}
+	}
+	s += strings.Join(parts, ", ")
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, ".") {
+		s += "."
+	}
+	if doi := e.Fields["doi"]; doi != "" {
+		s += " doi: [" + doi + "](https://doi.org/" + doi + ")."
+	} else if url := e.Fields["url"]; url != "" {
+		s += " <" + url + ">."
+	}
+	return s
+}
+
+func append(slice []string, element string) []string {
+	n := len(slice)
+	if n == cap(slice) {
+		// Slice is full; must grow.
+		// We double its size and add 1, so if the size is zero we still grow.
+		newSlice := make([]string, len(slice), 2*len(slice)+1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0 : n+1]
+	slice[n] = element
+	return slice
+}
+
+// The append function above only handles strings, and hides the builtin, so
+// this one grows slices of anything else.  Like append, it doubles the
+// slice when it is full, rather than copying it every time.
+func appendAny[T any](slice []T, elements ...T) []T {
+	n := len(slice)
+	if n+len(elements) > cap(slice) {
+		newSlice := make([]T, n, 2*(n+len(elements))+1)
+		copy(newSlice, slice)
+		slice = newSlice
+	}
+	slice = slice[0 : n+len(elements)]
+	copy(slice[n:], elements)
+	return slice
+}
+
+// "Smart" punctuation for prose, i.e. quotation marks, ellipses and
+// fractions, plus escaping the characters TeX treats specially.  Only
+// prose gets here: see escapeTeX.
+func smart_punc(line string) string {
+	line = strings.NewReplacer("#", "\\#", "$", "\\$", "%", "\\%",
+		"&", "\\&", "_", "\\_", "{", "\\{", "}", "\\}").Replace(line)
+
+	re_el := regexp.MustCompile(`\.\.\.`) // ellipsis
+	line = re_el.ReplaceAllString(line, "\\ldots{}")
+
+	re_qo := regexp.MustCompile("(^|[\\s\\(])\"") // open quotation mark
+	line = re_qo.ReplaceAllString(line, "$1``")
+
+	re_qc := regexp.MustCompile("\"") // close quotation mark
+	line = re_qc.ReplaceAllString(line, "''")
+
+	re_frac := regexp.MustCompile(`(^|\s)(\d+)/(\d+)(\s|$)`) // TeX-ify fraction
+	line = re_frac.ReplaceAllString(line, "$1$$\\frac{$2}{$3}$$$4")
+	return (line)
+}
+
+/*******************************************************************************
+*                                                                              *
+* Fenced code blocks, as in Pandoc:                                            *
+*                                                                              *
+*     ```python {.numberLines startFrom=10 hl=11-12}                           *
+*     ...                                                                      *
+*     ```                                                                      *
+*                                                                              *
+* The language may also be given as the first class.  numberLines turns on    *
+* line numbers, startFrom sets the first, and hl highlights lines (by their    *
+* numbers).  TeX gets listings or minted (see CodePackage), and frames with    *
+* code in them are made fragile.  The HTML is highlighted here, so it needs    *
+* neither Pandoc's highlighter nor JavaScript.                                 *
+*                                                                              *
+*******************************************************************************/
+
+type Code struct {
+	Lang      string
+	Lines     []string
+	Numbers   bool
+	Start     int
+	Highlight string // Line ranges, e.g. 2-3,5
+	Run       bool   // Run the code, and show its output
+	Timeout   int    // In seconds
+	Output    bool   // This is the output of some code
+	Attrs     map[string]string
+}
+
+var re_fence = regexp.MustCompile("^\\s*(`{3,}|~{3,})\\s*([\\w+#.\\-]*)\\s*(\\{[^{}]*\\})?\\s*$")
+
+// Tries to read a fenced code block starting at lines[i].  Returns it and
+// the number of lines it used, which is zero if there isn't one.
+func parseCode(lines []string, i int) (Code, int) {
+	m := re_fence.FindStringSubmatch(lines[i])
+	if m == nil {
+		return Code{}, 0
+	}
+	fence := m[1]
+	complain := func(s string) {
+		if !collecting {
+			warn(s)
+		}
+	}
+	c := Code{Lang: strings.ToLower(m[2]), Start: 1}
+	_, attrs := splitAttrs(m[3])
+	c.Attrs = attrs
+	for _, class := range strings.Fields(attrs["."]) {
+		switch class {
+		case "numberLines", "number-lines":
+			c.Numbers = true
+		case "run", "exec":
+			c.Run = true
+		default:
+			if c.Lang == "" {
+				c.Lang = strings.ToLower(class)
+			}
+		}
+	}
+	if s := attrs["startFrom"]; s != "" {
+		if n, e := strconv.Atoi(s); e == nil {
+			c.Start = n
+			c.Numbers = true
+		} else {
+			complain("startFrom must be a number, not '" + s + "' (line " +
+				strconv.Itoa(line_number) + ")")
+		}
+	}
+	c.Timeout = o.execTimeout
+	if t := attrs["timeout"]; t != "" {
+		if n, e := strconv.Atoi(t); e == nil && n > 0 {
+			c.Timeout = n
+		} else {
+			complain("timeout must be a number of seconds, not '" + t + "' (line " +
+				strconv.Itoa(line_number) + ")")
+		}
+	}
+	c.Highlight = attrs["hl"]
+	if c.Highlight == "" {
+		c.Highlight = attrs["highlight"]
+	}
+	if c.Highlight != "" && !regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`).MatchString(c.Highlight) {
+		complain("ignoring bad line ranges '" + c.Highlight + "' (line " +
+			strconv.Itoa(line_number) + ")")
+		c.Highlight = ""
+	}
+
+	for j := i + 1; j < len(lines); j++ {
+		t := strings.TrimSpace(lines[j])
+		if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			return c, j - i + 1
+		}
+		c.Lines = append(c.Lines, lines[j])
+	}
+	complain("the code block on line " + strconv.Itoa(line_number) + " is never closed")
+	return c, len(lines) - i
+}
+
+// The line numbers in a list of ranges, e.g. 2-3,5
+func lineRanges(s string) map[int]bool {
+	lines := map[int]bool{}
+	for _, r := range strings.Split(s, ",") {
+		ends := strings.SplitN(r, "-", 2)
+		from, _ := strconv.Atoi(ends[0])
+		to := from
+		if len(ends) == 2 {
+			to, _ = strconv.Atoi(ends[1])
+		}
+		for n := from; n <= to; n++ {
+			lines[n] = true
+		}
+	}
+	return lines
+}
+
+func emitCode(c Code) {
+	md_skip = true
+	addMDlines("\n" + codeHTML(c) + "\n")
+	tex := codeTeX(c)
+	addNotesSlides(tex, tex)
+	if c.Run {
+		if out := runCode(c); out != nil {
+			emitCode(Code{Lines: out, Start: 1, Output: true})
+		}
+	}
+}
+
+// The names listings knows languages by
+var listingsLangs = map[string]string{
+	"c": "C", "cpp": "C++", "c++": "C++", "java": "Java", "python": "Python",
+	"py": "Python", "bash": "bash", "sh": "sh", "shell": "bash", "r": "R",
+	"sql": "SQL", "haskell": "Haskell", "html": "HTML", "xml": "XML",
+	"perl": "Perl", "ruby": "Ruby", "matlab": "Matlab", "tex": "TeX",
+	"latex": "TeX", "go": "Go", "javascript": "JavaScript", "js": "JavaScript",
+}
+
+// listings doesn't know Go or JavaScript, so they are defined here
+const listingsExtras = `\lstdefinelanguage{Go}{morekeywords={break,case,chan,const,continue,default,defer,else,fallthrough,for,func,go,goto,if,import,interface,map,package,range,return,select,struct,switch,type,var},sensitive=true,morecomment=[l]{//},morecomment=[s]{/*}{*/},morestring=[b]",morestring=[b]',morestring=[b]` + "`" + `}
+\lstdefinelanguage{JavaScript}{morekeywords={break,case,catch,class,const,continue,default,delete,do,else,export,extends,finally,for,function,if,import,in,instanceof,let,new,return,switch,this,throw,try,typeof,var,void,while,yield,async,await},sensitive=true,morecomment=[l]{//},morecomment=[s]{/*}{*/},morestring=[b]",morestring=[b]'}
+`
+
+func codeTeX(c Code) string {
+	if o.codePackage == "minted" {
+		usePackage("minted")
+		opts := []string{}
+		if c.Numbers {
+			opts = appendAny(opts, "linenos", "firstnumber="+strconv.Itoa(c.Start))
+		}
+		if c.Highlight != "" {
+			opts = append(opts, "highlightlines={"+c.Highlight+"}")
+		}
+		lang := c.Lang
+		if lang == "" {
+			lang = "text"
+		}
+		if c.Output {
+			opts = appendAny(opts, "bgcolor=black!5")
+		}
+		return "\\begin{minted}[" + strings.Join(opts, ",") + "]{" + lang + "}\n" +
+			strings.Join(c.Lines, "\n") + "\n\\end{minted}\n"
+	}
+
+	if !strings.Contains(o.TeXPreambleCommon, "\\lstset{") {
+		usePackage("listings")
+		usePackage("xcolor")
+		o.TeXPreambleCommon += "\\lstset{basicstyle=\\ttfamily\\small," +
+			"keywordstyle=\\color{blue}\\bfseries,commentstyle=\\color{green!50!black}\\itshape," +
+			"stringstyle=\\color{red!60!black},numberstyle=\\tiny\\color{gray}," +
+			"columns=fullflexible,keepspaces=true,showstringspaces=false," +
+			"escapeinside={(*@}{@*)}}\n" + listingsExtras +
+			"\\lstdefinestyle{output}{basicstyle=\\ttfamily\\small\\color{black!70}," +
+			"backgroundcolor=\\color{black!5},frame=leftline}\n"
+	}
+	opts := []string{}
+	if c.Output {
+		opts = append(opts, "style=output")
+	}
+	if lang, ok := listingsLangs[c.Lang]; ok {
+		opts = append(opts, "language="+lang)
+	}
+	if c.Numbers {
+		opts = appendAny(opts, "numbers=left", "firstnumber="+strconv.Itoa(c.Start))
+	}
+	hl := lineRanges(c.Highlight)
+	lines := []string{}
+	for k, l := range c.Lines {
+		if hl[c.Start+k] {
+			// A coloured bar behind the line
+			l = "(*@\\makebox[0pt][l]{\\color{yellow!30}\\rule[-0.4ex]{\\linewidth}{2.4ex}}@*)" + l
+		}
+		lines = append(lines, l)
+	}
+	s := "\\begin{lstlisting}"
+	if len(opts) > 0 {
+		s += "[" + strings.Join(opts, ",") + "]"
+	}
+	return s + "\n" + strings.Join(lines, "\n") + "\n\\end{lstlisting}\n"
+}
+
+// Makes the frames with code in them fragile, as Beamer needs.
+func fragileFrames(body string) string {
+	frames := strings.Split(body, "\\begin{frame}")
+	for i, f := range frames[1:] {
+		end := strings.Index(f, "\\end{frame}")
+		if end < 0 {
+			end = len(f)
+		}
+		content := f[:end]
+		if !strings.Contains(content, "\\begin{lstlisting}") &&
+			!strings.Contains(content, "\\begin{minted}") &&
+			!strings.Contains(content, "\\begin{verbatim}") &&
+			!strings.Contains(content, "\\verb") {
+			continue
+		}
+		if strings.HasPrefix(f, "[") {
+			frames[i+1] = "[fragile," + f[1:]
+		} else {
+			frames[i+1] = "[fragile]" + f
+		}
+	}
+	return strings.Join(frames, "\\begin{frame}")
+}
+
+/*******************************************************************************
+*                                                                              *
+* Exercises and solutions, as Pandoc's fenced divs:                            *
+*                                                                              *
+*     ::: exercise Sums {#ex:sums}                                             *
+*     Add up the numbers from 1 to 100.                                        *
+*     :::                                                                      *
+*     ::: solution                                                             *
+*     5050, as Gauss found.                                                    *
+*     :::                                                                      *
+*                                                                              *
+* Exercises are numbered, and can be referred to as @ex:sums.  A solution      *
+* belongs to the exercise before it.  Solutions are kept out of the text: by   *
+* default they go in a Solutions section at the end of the notes, or in a      *
+* file of their own (Solutions = separate), as lecture-solutions.tex and       *
+* lecture-solutions.md, or nowhere (Solutions = none).                         *
+*                                                                              *
+*******************************************************************************/
+
+var re_div = regexp.MustCompile(`^\s*:{3,}\s*(.*)$`)
+
+// Reads the fence of a div: its kind (e.g. exercise, or "" for the fence
+// that closes it), its title, if any, and its label, if any.
+func parseDiv(line string) (kind, title, label string, ok bool) {
+	m := re_div.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", "", false
+	}
+	rest, attrs := splitAttrs(m[1])
+	if words := strings.Fields(rest); len(words) > 0 {
+		kind, title = words[0], strings.Join(words[1:], " ")
+	} else if classes := strings.Fields(attrs["."]); len(classes) > 0 {
+		kind = classes[0] // Pandoc's form, e.g. ::: {.exercise #ex:sums}
+	}
+	if label = attrs["#"]; label != "" && !strings.HasPrefix(label, "ex:") {
+		label = "ex:" + label
+	}
+	return kind, title, label, true
+}
+
+// A div that is open, and the line of its fence.
+type Div struct {
+	Kind string
+	Line int
+}
+
+var divStack []Div // The exercises and solutions open, and the divs in them
+var exerciseCount int
+var exerciseLabel string // The label of the last exercise
+var solutionsTeX []string
+var solutionsMD []string
+var savedTeX, savedMD []string // The notes, while a solution is written
+var savedNotesOnly bool
+
+// Whether a div is one of ours, rather than one for Pandoc.  A closing
+// fence is ours if the div it closes is.
+func isExerciseDiv(kind string) bool {
+	if kind == "" && len(divStack) > 0 {
+		kind = divStack[len(divStack)-1].Kind
+	}
+	return kind == "exercise" || kind == "solution"
+}
+
+// Keeps track of Pandoc's divs inside ours, so that the fences closing
+// them aren't taken for ours.
+func pandocDiv(kind string) {
+	switch {
+	case len(divStack) == 0:
+	case kind == "":
+		divStack = divStack[:len(divStack)-1]
+	default:
+		divStack = appendAny(divStack, Div{kind, line_number})
+	}
+}
+
+// Closes the divs left open at the end of the input.  A solution left
+// open would otherwise take the notes with it.
+func closeDivs() {
+	for len(divStack) > 0 {
+		d := divStack[len(divStack)-1]
+		if !isExerciseDiv(d.Kind) {
+			divStack = divStack[:len(divStack)-1]
+			continue
+		}
+		error("The "+d.Kind+" on line "+strconv.Itoa(d.Line)+" is never closed", "missing :::")
+		exerciseDiv("", "", "")
+	}
+}
+
+// Opens or closes an exercise or a solution.  A solution is written as
+// notes, but into a buffer of its own, from which it goes to the Solutions.
+func exerciseDiv(kind, title, label string) {
+	md_skip = true // Before popEnvs, which would copy the fence there
+	popEnvs()
+	switch kind {
+	case "exercise":
+		exerciseCount++
+		n := strconv.Itoa(exerciseCount)
+		if label == "" {
+			label = "ex:" + n
+		}
+		exerciseLabel = label
+		heading, headingMD := "Exercise "+n, "Exercise "+n
+		if title != "" {
+			heading += " (" + process_md(title) + ")"
+			headingMD += " (" + title + ")"
+		}
+		addMDlines("\n::: {.exercise #" + label + "}\n**" + headingMD + ".**\n")
+		addNotesSlides("\\begin{trivlist}\\phantomsection\\label{"+label+"}\n"+
+			"\\item[\\hskip\\labelsep\\textbf{"+heading+".}]\n",
+			"\\begin{block}{"+heading+"}\\hypertarget{"+label+"}{}\n")
+	case "solution":
+		if exerciseCount == 0 {
+			warn("the solution on line " + strconv.Itoa(line_number) + " has no exercise")
+		}
+		savedTeX, savedMD, savedNotesOnly = notesTeXlines, markdownLines, NotesOnly
+		notesTeXlines, markdownLines, NotesOnly = nil, nil, true
+	case "":
+		open := divStack[len(divStack)-1].Kind
+		divStack = divStack[:len(divStack)-1]
+		if open == "exercise" {
+			addMDlines(":::\n")
+			addNotesSlides("\\end{trivlist}\n", "\\end{block}\n")
+			return
+		}
+		sol, solMD := strings.Join(notesTeXlines, ""), strings.Join(markdownLines, "")
+		notesTeXlines, markdownLines, NotesOnly = savedTeX, savedMD, savedNotesOnly
+		ref, refMD := "Exercise~"+strconv.Itoa(exerciseCount), "Exercise "+strconv.Itoa(exerciseCount)
+		if o.solutions == "appendix" {
+			// Link back to the exercise, which is in the same file
+			ref = "\\hyperref[" + exerciseLabel + "]{" + ref + "}"
+			refMD = "[" + refMD + "](#" + exerciseLabel + ")"
+		}
+		solutionsTeX = append(solutionsTeX, "\\begin{trivlist}\n"+
+			"\\item[\\hskip\\labelsep\\textbf{Solution to "+ref+".}]\n"+sol+"\\end{trivlist}\n")
+		solutionsMD = append(solutionsMD, "\n::: {.solution}\n**Solution to "+refMD+".**\n"+
+			solMD+"\n:::\n")
+		return
+	}
+	divStack = appendAny(divStack, Div{kind, line_number})
+}
+
+// Writes the solutions in a file of their own, with the same preamble as
+// the notes.
+func writeSolutions(filename, top, bottom string) {
+	f := baseName(filename) + "-solutions" + audienceSuffix()
+	writeOutput(f+".tex", top+"\\section*{Solutions}\n"+sectionNumbers(strings.Join(solutionsTeX, "\n"))+bottom)
+	if run_TeX {
+		info("====> Formatting solutions with TeX")
+		if runTeX(f, "solutions") {
+			cleanUp(f + ".aux " + f + ".log " + f + ".out " + f + ".run.xml " + f + ".bcf")
+		}
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* Cloze blanks, e.g. "The capital of France is {{Paris}}."  The notes and     *
+* slides show the answer, underlined.  The handout (lecture-handout.tex) is    *
+* the notes with a blank as wide as each answer, and, with ClozeKey = true,    *
+* the blanks numbered and a key to them in lecture-handout-key.tex.            *
+*                                                                              *
+*******************************************************************************/
+
+var hasClozes bool
+
+// Defines \cloze for the notes and slides.
+func clozePreamble() string {
+	if !hasClozes {
+		return ""
+	}
+	return "\\newcommand{\\cloze}[1]{\\underline{#1}}\n"
+}
+
+// Turns blanks into Pandoc's underlining, for the Markdown.  Code is left
+// alone.
+func clozeMD(line string) string {
+	re_cloze := regexp.MustCompile("(`+)[^`]*`+|\\{\\{")
+	out := ""
+	for {
+		loc := re_cloze.FindStringIndex(line)
+		if loc == nil {
+			return out + line
+		}
+		k := -1
+		if line[loc[0]] == '{' {
+			k = clozeEnd(line[loc[0]:])
+		}
+		if k < 0 {
+			out += line[:loc[1]]
+			line = line[loc[1]:]
+			continue
+		}
+		out += line[:loc[0]] + "[" + line[loc[0]+2:loc[0]+k] + "]{.underline}"
+		line = line[loc[0]+k+2:]
+	}
+}
+
+// The index of the "}}" that ends the blank at the start of s, or -1.
+// Braces inside the answer, e.g. {{\frac{a}{b}}}, are matched.
+func clozeEnd(s string) int {
+	if k := matchBrace(s, 1); k > 0 && k+1 < len(s) && s[k+1] == '}' {
+		return k
+	}
+	return -1
+}
+
+// Writes the handout, which is the notes with the answers blanked out, and
+// its key, if one is wanted.
+func writeHandout(filename, top, body, bottom string) {
+	f := baseName(filename) + "-handout" + audienceSuffix()
+	blank := "\\renewcommand{\\cloze}[1]{\\underline{\\hphantom{#1}}}\n"
+	if o.clozeKey {
+		blank = "\\newcounter{cloze}\n\\renewcommand{\\cloze}[1]{\\stepcounter{cloze}" +
+			"\\textsuperscript{\\thecloze}\\underline{\\hphantom{#1}}}\n"
+	}
+	files := []string{f}
+	writeOutput(f+".tex", top+blank+body+bottom)
+	if o.clozeKey {
+		// The answers, in the order of the blanks
+		key := ""
+		for rest := body; ; {
+			k := strings.Index(rest, "\\cloze{")
+			if k < 0 {
+				break
+			}
+			end := matchBrace(rest, k+len("\\cloze"))
+			if end < 0 {
+				break
+			}
+			key += "\\item " + rest[k+len("\\cloze{"):end] + "\n"
+			rest = rest[end+1:]
+		}
+		files = append(files, f+"-key")
+		writeOutput(f+"-key.tex", top+"\\section*{Answers}\n\\begin{enumerate}\n"+
+			key+"\\end{enumerate}\n"+bottom)
+	}
+	if run_TeX {
+		info("====> Formatting the handout with TeX")
+		for _, h := range files {
+			if runTeX(h, "handout") {
+				cleanUp(h + ".aux " + h + ".log " + h + ".out " + h + ".run.xml " + h + ".bcf")
+			}
+		}
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* Audiences.  Lines and blocks can be tagged for some audiences only:          *
+*                                                                              *
+*     [only:instructor] The answer is 42.                                      *
+*     [except:student]                                                         *
+*     ...                                                                      *
+*     [end]                                                                    *
+*                                                                              *
+* A build for an audience (-a student) keeps what is tagged for it, and       *
+* writes e.g. lecture-notes-student.tex.  An audience's tags are its name,     *
+* or as given in snp.ini, e.g. "Audience = student: student, handout".         *
+* With no audience, only untagged lines and except: ones are kept.             *
+*                                                                              *
+*******************************************************************************/
+
+var re_tag = regexp.MustCompile(`^\s*\[(only|except):([\w\-, ]+)\]\s*`)
+
+// Whether a tag (e.g. only:instructor) lets its lines into this build.
+func tagActive(kind, tags string) bool {
+	active := map[string]bool{}
+	if audience != "" {
+		names, ok := o.audienceTags[audience]
+		if !ok {
+			names = []string{audience}
+		}
+		for _, n := range names {
+			active[n] = true
+		}
+	}
+	tagged := false
+	for _, t := range strings.Split(tags, ",") {
+		tagged = tagged || active[strings.TrimSpace(t)]
+	}
+	return tagged == (kind == "only")
+}
+
+var sourceLines []int // The line of the source each line of the input is
+
+// The line of the source that line i (from 0) of the input came from.
+func sourceLine(i int) int {
+	if i < len(sourceLines) {
+		return sourceLines[i]
+	}
+	return i + 1
+}
+
+// Drops the lines that aren't for this audience, and the tags of those
+// that are.  Tags in code and in [bv] ... [ev] are left alone.  Dropped
+// lines become comments, except in a table or a paragraph, which a
+// comment would split; sourceLines keeps the numbers for messages.
+func audienceLines(lines []string) []string {
+	out := []string{}
+	src := 0
+	keep := func(line string) {
+		out = append(out, line)
+		sourceLines = appendAny(sourceLines, src)
+	}
+	stack := []bool{} // Whether each open block is kept
+	kept := func() bool {
+		for _, k := range stack {
+			if !k {
+				return false
+			}
+		}
+		return true
+	}
+	drop := func() {
+		if n := len(out); n == 0 || blank(out[n-1]) || out[n-1] == "%" {
+			keep("%")
+		}
+	}
+	fence, verbatim := "", false // The code or [bv] block we're in, if any
+	for i, line := range lines {
+		src = i + 1
+		f := re_fence.FindStringSubmatch(line)
+		keys := strings.Fields(line)
+		switch {
+		case fence != "":
+			if f != nil && f[2] == "" && strings.HasPrefix(f[1], fence) {
+				fence = ""
+			}
+		case verbatim:
+			verbatim = len(keys) == 0 || keys[0] != "[ev]"
+		case f != nil:
+			fence = f[1]
+		case len(keys) > 0 && keys[0] == "[bv]":
+			verbatim = true
+		case strings.TrimSpace(line) == "[end]":
+			if len(stack) == 0 {
+				error("[end] on line "+strconv.Itoa(i+1)+" closes no tagged block", "")
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			drop()
+			continue
+		default:
+			if m := re_tag.FindStringSubmatch(line); m != nil {
+				rest := line[len(m[0]):]
+				if strings.TrimSpace(rest) == "" {
+					stack = appendAny(stack, tagActive(m[1], m[2]))
+					drop()
+				} else if kept() && tagActive(m[1], m[2]) {
+					keep(rest)
+				} else {
+					drop()
+				}
+				continue
+			}
+		}
+		if kept() {
+			keep(line)
+		} else {
+			drop()
+		}
+	}
+	if len(stack) > 0 {
+		error("A tagged block is never closed", "missing [end]")
+	}
+	return out
+}
+
+// The end of the names of the output files, e.g. -student.
+func audienceSuffix() string {
+	if audience == "" {
+		return ""
+	}
+	return "-" + audience
+}
+
+// Builds the notes and slides for each of several audiences, by running
+// snp again for each one.
+func buildAudiences(filename string, audiences []string) {
+	args := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "a" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	for _, a := range audiences {
+		info("====> Building for " + a)
+		cmd := exec.Command(os.Args[0], appendAny(args, "-a="+a, filename)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			error("The build for "+a+" failed", err.Error())
+		}
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* Diagrams.  A code block in dot (Graphviz), tikz or plantuml is drawn when    *
+* the notes are built, and shown as a graphic, e.g.                            *
+*                                                                              *
+*     ```dot {#fig:flow caption="The flow of control" notes-width=60%}         *
+*                                                                              *
+* The attributes are those of images (see imageAttrs), plus the caption.       *
+* Drawings are cached by a hash of their source, and go to the image pipeline *
+* like any other graphic, so each output gets the format it prefers.          *
+*                                                                              *
+*******************************************************************************/
+
+// What a figure shows when its diagram couldn't be drawn
+const placeholder = "(The diagram couldn't be drawn: its source follows.)"
+
+var diagramLangs = map[string]string{"dot": "dot", "graphviz": "dot",
+	"tikz": "tikz", "plantuml": "plantuml"}
+
+// Draws a diagram (or finds it in the cache), and returns the path of the
+// drawing.
+func renderDiagram(c Code) (string, bool) {
+	lang := diagramLangs[c.Lang]
+	src := strings.Join(c.Lines, "\n") + "\n"
+	sum := sha256.Sum256([]byte(lang + "\n" + src))
+	dir := filepath.Join(o.cacheDir, "diagrams")
+	base := filepath.Join(dir, hex.EncodeToString(sum[:12]))
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		warn("can't make the diagram cache " + dir + ": " + e.Error())
+		return "", false
+	}
+	write := func(path, s string) bool {
+		if e := ioutil.WriteFile(path, []byte(s), 0644); e != nil {
+			warn("can't write the diagram on line " + strconv.Itoa(line_number) + ": " + e.Error())
+			return false
+		}
+		return true
+	}
+
+	switch lang {
+	case "dot":
+		if !write(base+".dot", src) {
+			return "", false
+		}
+		for _, ext := range []string{"pdf", "svg"} {
+			if found, _ := fileExists(base+"."+ext, ""); !found &&
+				!runProg("dot", []string{"-T" + ext, "-o", base + "." + ext, base + ".dot"}) {
+				return "", false
+			}
+		}
+		return base + ".pdf", true
+
+	case "tikz":
+		if found, _ := fileExists(base+".pdf", ""); found {
+			return base + ".pdf", true
+		}
+		// Libraries and packages belong in the preamble
+		preamble, body := "", ""
+		for _, l := range c.Lines {
+			t := strings.TrimSpace(l)
+			if strings.HasPrefix(t, "\\usetikzlibrary") || strings.HasPrefix(t, "\\usepackage") {
+				preamble += l + "\n"
+			} else {
+				body += l + "\n"
+			}
+		}
+		if !strings.Contains(body, "\\begin{tikzpicture}") {
+			body = "\\begin{tikzpicture}\n" + body + "\\end{tikzpicture}\n"
+		}
+		tex := "\\documentclass[tikz]{standalone}\n" + preamble +
+			"\\begin{document}\n" + body + "\\end{document}\n"
+		if strings.Contains(src, "\\documentclass") {
+			tex = src
+		}
+		if !write(base+".tex", tex) {
+			return "", false
+		}
+		ok := runProg("xelatex", []string{"-interaction=nonstopmode", "-halt-on-error",
+			"-output-directory=" + dir, base + ".tex"})
+		cleanUp(base + ".aux " + base + ".log")
+		return base + ".pdf", ok
+
+	case "plantuml":
+		if o.plantUML == "" {
+			warn("set PlantUMLJar in snp.ini to draw PlantUML diagrams")
+			return "", false
+		}
+		if found, _ := fileExists(base+".svg", ""); found {
+			return base + ".svg", true
+		}
+		if !write(base+".puml", src) {
+			return "", false
+		}
+		return base + ".svg", runProg("java", []string{"-jar", o.plantUML, "-tsvg", base + ".puml"})
+	}
+	return "", false
+}
+
+// Reads a diagram's caption and image attributes into a figure.
+func diagramFigure(c Code, path string) Figure {
+	attrs := map[string]string{}
+	for k, v := range c.Attrs {
+		if k != "caption" && k != "." {
+			attrs[k] = v
+		}
+	}
+	f := Figure{Path: path, Caption: c.Attrs["caption"]}
+	imageAttrs(&f, attrs)
+	return f
+}
+
+func emitDiagram(c Code) {
+	path, ok := renderDiagram(c)
+	if !ok {
+		error("Can't draw the "+c.Lang+" diagram on line "+strconv.Itoa(line_number),
+			"showing its source instead")
+		if f := diagramFigure(c, ""); f.Caption != "" {
+			// It still has its number, which collectLabels gave it
+			figureCount++
+			f.Number = figureCount
+			addMDlines(figureMD(f))
+			addNotesSlides(figureTeX(f, f.Notes), figureTeX(f, f.Slides))
+		}
+		emitCode(Code{Lang: c.Lang, Lines: c.Lines, Start: 1})
+		return
+	}
+	emitFigure(diagramFigure(c, path))
+}
+
+/*******************************************************************************
+*                                                                              *
+* Runnable code.  A code block with the run class, e.g.                        *
+*                                                                              *
+*     ```python {.run timeout=5}                                               *
+*                                                                              *
+* is run when the notes are built, and what it prints (on stdout and stderr)   *
+* is shown below it.  Outputs are cached by a hash of the code, so only new or *
+* changed blocks are run again.  With -no-exec nothing is run, and blocks that *
+* aren't in the cache say so.                                                  *
+*                                                                              *
+*******************************************************************************/
+
+// How to run each language: the file to write the code to, and the
+// command to run it with
+var runners = map[string][]string{
+	"go":     {"main.go", "go", "run", "main.go"},
+	"python": {"main.py", "python3", "main.py"},
+	"py":     {"main.py", "python3", "main.py"},
+	"bash":   {"main.sh", "bash", "main.sh"},
+	"sh":     {"main.sh", "sh", "main.sh"},
+	"shell":  {"main.sh", "bash", "main.sh"},
+	"r":      {"main.R", "Rscript", "main.R"},
+}
+
+var noExec bool
+
+// Runs a block of code, or fetches its output from the cache.
+func runCode(c Code) []string {
+	runner, ok := runners[c.Lang]
+	if !ok {
+		warn("don't know how to run " + c.Lang + " code (line " +
+			strconv.Itoa(line_number) + ")")
+		return nil
+	}
+	code := strings.Join(c.Lines, "\n") + "\n"
+	sum := sha256.Sum256([]byte(strings.Join(runner, " ") + "\n" + code))
+	cached := filepath.Join(o.cacheDir, "exec", hex.EncodeToString(sum[:]))
+	if out, e := ioutil.ReadFile(cached); e == nil {
+		return outputLines(string(out))
+	}
+	if noExec {
+		return []string{"(not run: -no-exec)"}
+	}
+
+	dir, e := ioutil.TempDir("", "snp-run")
+	if e != nil {
+		error("Can't run the code on line "+strconv.Itoa(line_number), e.Error())
+		return nil
+	}
+	defer os.RemoveAll(dir)
+	if e := ioutil.WriteFile(filepath.Join(dir, runner[0]), []byte(code), 0644); e != nil {
+		error("Can't run the code on line "+strconv.Itoa(line_number), e.Error())
+		return nil
+	}
+
+	timeout := time.Duration(c.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, runner[1], runner[2:]...)
+	cmd.Dir = dir
+	cmd.WaitDelay = time.Second // Don't wait for children that outlive it
+	info("====> Running the " + c.Lang + " code on line " + strconv.Itoa(line_number))
+	output, err := cmd.CombinedOutput()
+	out := strings.TrimRight(string(output), "\n")
+	if ctx.Err() == context.DeadlineExceeded {
+		// Not cached, so it gets another chance next time
+		warn("the code on line " + strconv.Itoa(line_number) + " timed out")
+		return strings.Split(out+"\n(timed out after "+timeout.String()+")", "\n")
+	}
+	if err != nil {
+		if _, exited := err.(*exec.ExitError); !exited {
+			error("Can't run the code on line "+strconv.Itoa(line_number), err.Error())
+			return nil
+		}
+		out += "\n(" + err.Error() + ")"
+	}
+	os.MkdirAll(filepath.Dir(cached), 0755)
+	if e := ioutil.WriteFile(cached, []byte(out+"\n"), 0644); e != nil {
+		warn("can't cache the output of the code on line " + strconv.Itoa(line_number) +
+			", so it will be run again next time: " + e.Error())
+	}
+	return outputLines(out)
+}
+
+// Splits output into lines, or returns nil if there isn't any.
+func outputLines(out string) []string {
+	out = strings.Trim(out, "\n")
+	if out == "" {
+		return nil
+	}
+	return strings.Split(out, "\n")
+}
+
+/*******************************************************************************
+*                                                                              *
+* A small syntax highlighter for the HTML.  Each language is described by its  *
+* keywords, comments and string quotes, which is enough for teaching code.     *
+*                                                                              *
+*******************************************************************************/
+
+type Lexer struct {
+	Keywords map[string]bool
+	Comments []string  // Line comments
+	Block    [2]string // Block comments, if the language has them
+	Quotes   string
+}
+
+func newLexer(keywords string, comments []string, block [2]string, quotes string) Lexer {
+	k := map[string]bool{}
+	for _, w := range strings.Fields(keywords) {
+		k[w] = true
+	}
+	return Lexer{k, comments, block, quotes}
+}
+
+var cLike = "break case char const continue default do double else enum extern float for goto if int long return short signed sizeof static struct switch typedef union unsigned void volatile while"
+
+var lexers = map[string]Lexer{
+	"go": newLexer("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var true false nil",
+		[]string{"//"}, [2]string{"/*", "*/"}, "\"'`"),
+	"python": newLexer("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield True False None",
+		[]string{"#"}, [2]string{}, "\"'"),
+	"c":   newLexer(cLike, []string{"//"}, [2]string{"/*", "*/"}, "\"'"),
+	"cpp": newLexer(cLike+" bool catch class delete false friend inline namespace new nullptr operator private protected public template this throw true try using virtual", []string{"//"}, [2]string{"/*", "*/"}, "\"'"),
+	"java": newLexer("abstract boolean break byte case catch char class continue default do double else enum extends final finally float for if implements import instanceof int interface long new package private protected public return short static super switch this throw throws try void while true false null",
+		[]string{"//"}, [2]string{"/*", "*/"}, "\"'"),
+	"javascript": newLexer("async await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new return switch this throw try typeof var void while yield true false null undefined",
+		[]string{"//"}, [2]string{"/*", "*/"}, "\"'`"),
+	"bash": newLexer("if then else elif fi for while until do done case esac function in return local export",
+		[]string{"#"}, [2]string{}, "\"'"),
+	"r": newLexer("if else repeat while function for in next break TRUE FALSE NULL Inf NaN NA return library",
+		[]string{"#"}, [2]string{}, "\"'"),
+	"sql": newLexer("select from where and or not insert into values update set delete create table drop alter join inner left right outer on group by order having as distinct null is in like limit SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER JOIN INNER LEFT RIGHT OUTER ON GROUP BY ORDER HAVING AS DISTINCT NULL IS IN LIKE LIMIT",
+		[]string{"--"}, [2]string{"/*", "*/"}, "'\""),
+}
+
+var lexerAliases = map[string]string{"py": "python", "c++": "cpp", "js": "javascript",
+	"sh": "bash", "shell": "bash", "golang": "go"}
+
+const codeCSS = `<style>
+pre.code { background: #f8f8f8; padding: 0.5em; overflow-x: auto; }
+pre.code .kw { color: #00c; font-weight: bold; }
+pre.code .str { color: #a31515; }
+pre.code .com { color: #080; font-style: italic; }
+pre.code .num { color: #098658; }
+pre.code .ln { color: #999; display: inline-block; width: 2.5em; user-select: none; }
+pre.code .hl { background: #ffc; display: inline-block; width: 100%; }
+pre.output { background: #eee; border-left: 3px solid #999; margin-top: -0.5em; }
+</style>
+`
+
+var codeStyled bool // Whether the CSS is in the Markdown file yet
+
+func codeHTML(c Code) string {
+	lang := c.Lang
+	if a, ok := lexerAliases[lang]; ok {
+		lang = a
+	}
+	lx, known := lexers[lang]
+	hl := lineRanges(c.Highlight)
+
+	s := ""
+	if !codeStyled {
+		s, codeStyled = codeCSS, true
+	}
+	class := ""
+	if c.Lang != "" {
+		class = " class=\"language-" + c.Lang + "\""
+	}
+	pre := "code"
+	if c.Output {
+		pre = "code output"
+	}
+	s += "<pre class=\"" + pre + "\"><code" + class + ">"
+	inBlock := false
+	for k, l := range c.Lines {
+		line := ""
+		if known {
+			line, inBlock = highlightLine(l, lx, inBlock)
+		} else {
+			line = htmlEscape(l)
+		}
+		if c.Numbers {
+			line = "<span class=\"ln\">" + strconv.Itoa(c.Start+k) + "</span>" + line
+		}
+		class := "line"
+		if hl[c.Start+k] {
+			class += " hl"
+		}
+		// Every line is wrapped, so that Pandoc never sees a blank one
+		s += "<span class=\"" + class + "\">" + line + "</span>\n"
+	}
+	return s + "</code></pre>\n"
+}
+
+func htmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// Highlights a line of code, given whether it starts inside a block
+// comment.  Returns the HTML and whether the line ends inside one.
+func highlightLine(l string, lx Lexer, inBlock bool) (string, bool) {
+	out := ""
+	span := func(class, text string) {
+		out += "<span class=\"" + class + "\">" + htmlEscape(text) + "</span>"
+	}
+	i := 0
+	for i < len(l) {
+		rest := l[i:]
+		if inBlock {
+			k := strings.Index(rest, lx.Block[1])
+			if k < 0 {
+				span("com", rest)
+				return out, true
+			}
+			span("com", rest[:k+len(lx.Block[1])])
+			i += k + len(lx.Block[1])
+			inBlock = false
+			continue
+		}
+		if lx.Block[0] != "" && strings.HasPrefix(rest, lx.Block[0]) {
+			k := strings.Index(rest[len(lx.Block[0]):], lx.Block[1])
+			if k < 0 {
+				span("com", rest)
+				return out, true
+			}
+			k += len(lx.Block[0]) + len(lx.Block[1])
+			span("com", rest[:k])
+			i += k
+			continue
+		}
+		comment := false
+		for _, cm := range lx.Comments {
+			if strings.HasPrefix(rest, cm) {
+				comment = true
+			}
+		}
+		if comment {
+			span("com", rest)
+			break
+		}
+		c := l[i]
+		switch {
+		case strings.IndexByte(lx.Quotes, c) >= 0:
+			j := i + 1
+			for j < len(l) && l[j] != c {
+				if l[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(l) {
+				j = len(l) - 1
+			}
+			span("str", l[i:j+1])
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(l) && (isWordByte(l[j]) || l[j] == '.') {
+				j++
+			}
+			span("num", l[i:j])
+			i = j
+		case isWordByte(c):
+			j := i
+			for j < len(l) && isWordByte(l[j]) {
+				j++
+			}
+			if lx.Keywords[l[i:j]] {
+				span("kw", l[i:j])
+			} else {
+				out += htmlEscape(l[i:j])
+			}
+			i = j
+		default:
+			out += htmlEscape(l[i : i+1])
+			i++
+		}
+	}
+	return out, inBlock
+}
+
+/*******************************************************************************
+*                                                                              *
+* Footnotes, as in Pandoc: inline ones, ^[like this], and referenced ones,     *
+* like this[^1], defined on a line of their own:                               *
+*                                                                              *
+*     [^1]: The text of the note, which may go on over indented lines.         *
+*                                                                              *
+* The notes get real footnotes.  In the slides they go at the foot of the      *
+* frame, or only in the notes if SlideFootnotes is "notes".  Pandoc makes      *
+* the HTML's endnotes, with links back to the text, from the Markdown.         *
+*                                                                              *
+*******************************************************************************/
+
+var re_fn_def = regexp.MustCompile(`^\[\^([^\]\s]+)\]:\s*(.*)$`)
+var re_fn_ref = regexp.MustCompile(`\[\^([^\]\s]+)\]`)
+
+// Reads the definition of a footnote at lines[i], and returns its id,
+// its text and the number of lines it takes, or 0 if it isn't one.
+func parseFootnote(lines []string, i int) (string, string, int) {
+	m := re_fn_def.FindStringSubmatch(lines[i])
+	if m == nil {
+		return "", "", 0
+	}
+	text, n := m[2], 1
+	for i+n < len(lines) && (strings.HasPrefix(lines[i+n], "    ") ||
+		strings.HasPrefix(lines[i+n], "\t")) {
+		text += " " + strings.TrimSpace(lines[i+n])
+		n++
+	}
+	return m[1], strings.TrimSpace(text), n
+}
+
+// Turns references to footnotes into inline footnotes, so that the rest of
+// the processing sees only one kind.
+func inlineFootnotes(line string) string {
+	return re_fn_ref.ReplaceAllStringFunc(line, func(ref string) string {
+		id := re_fn_ref.FindStringSubmatch(ref)[1]
+		text, ok := footnotes[id]
+		if !ok {
+			warn("footnote [^" + id + "] is never defined (line " +
+				strconv.Itoa(line_number) + ")")
+			return ref
+		}
+		return "^[" + text + "]"
+	})
+}
+
+// Puts the footnotes in the slides at the foot of their frames (rather
+// than of a column, say), or takes them out.
+func slideFootnotes(body string) string {
+	out := ""
+	for {
+		k := strings.Index(body, "\\footnote{")
+		if k < 0 {
+			return out + body
+		}
+		end := matchBrace(body, k+len("\\footnote"))
+		if end < 0 {
+			return out + body
+		}
+		out += body[:k]
+		if o.slideFootnotes != "notes" {
+			out += "\\footnote[frame]" + body[k+len("\\footnote"):end+1]
+		}
+		body = body[end+1:]
+	}
+}
+
+/*******************************************************************************
+*                                                                              *
+* TeX escaping.  A line of source can mix prose with math, inline code, URLs,  *
+* citations and raw TeX commands, so escapeTeX splits it into those contexts   *
+* and escapes only the prose.  Math and raw TeX are copied as they are, and    *
+* code is escaped character by character inside \texttt.  References such as   *
+* @sec:intro are resolved here, so that the ties in them aren't taken for      *
+* Pandoc's subscripts; any other lone tilde is escaped.  Lines that are raw    *
+* TeX throughout ([preamble], [bv] ... [ev] blocks and comments) are left      *
+* alone, and so are the arguments of directives such as t and cb.              *
+*                                                                              *
+*******************************************************************************/
+
+// Commands whose arguments are labels, paths, URLs or TeX, rather than text
+var rawArgs = map[string]bool{
+	"url": true, "hyperref": true, "label": true, "ref": true,
+	"eqref": true, "pageref": true, "autoref": true, "cref": true,
+	"Cref": true, "nameref": true, "includegraphics": true, "input": true,
+	"include": true, "begin": true, "end": true, "usepackage": true,
+	"documentclass": true, "cite": true, "citep": true, "citet": true,
+	"citealp": true, "citeyear": true, "citeyearpar": true, "parencite": true,
+	"parencites": true, "textcite": true, "fullcite": true, "footcite": true,
+	"nocite": true, "setcounter": true, "addtocounter": true, "vspace": true,
+	"hspace": true, "rule": true, "newcommand": true, "renewcommand": true,
+	"def": true, "BeginAccSupp": true, "addbibresource": true,
+	"bibliography": true, "bibliographystyle": true, "frac": true,
+}
+
+var re_url = regexp.MustCompile(`^(https?://|www\.)[^\s<>]*[^\s<>.,;:!?)"']`)
+var re_cite_at = regexp.MustCompile(`^-?@(` + citeKey + `)`)
+
+func escapeTeX(line string) string {
+	if leave_alone || strings.HasPrefix(line, "[preamble]") {
+		return line
+	}
+	// Keep the markers of headings and comments
+	lead := regexp.MustCompile(`^\s*#*`).FindString(line)
+	if strings.HasPrefix(line[len(lead):], "%") {
+		return line
+	}
+	return lead + escapeText(line[len(lead):])
+}
+
+// Escapes a run of text, which may contain any of the contexts.
+func escapeText(s string) string {
+	out := ""
+	prose := ""
+	raw := func(r string) {
+		out += smart_punc(prose) + r
+		prose = ""
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		rest := s[i:]
+		switch {
+		case c == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			ticks := rest[:n]
+			if k := strings.Index(rest[n:], ticks); k >= 0 {
+				raw("\\texttt{" + escapeCode(strings.TrimSpace(rest[n:n+k])) + "}")
+				i += n + k + n - 1
+				continue
+			}
+			prose += ticks
+			i += n - 1
+
+		case c == '\\':
+			n := texCommand(rest)
+			if n > 0 {
+				raw(escapeArgs(rest[:n]))
+				i += n - 1
+				continue
+			}
+			raw("\\textbackslash{}")
+
+		case c == '$':
+			if n := mathLength(rest); n > 0 {
+				raw(rest[:n])
+				i += n - 1
+				continue
+			}
+			prose += "$"
+
+		case c == '@' && (i == 0 || !isWordByte(s[i-1])):
+			if loc := re_ref.FindStringIndex(rest); loc != nil && loc[0] == 0 {
+				if r := resolveRefs(rest[:loc[1]], false); r != rest[:loc[1]] {
+					raw(r)
+					i += loc[1] - 1
+					continue
+				}
+			}
+			if m := re_cite_at.FindString(rest); m != "" {
+				raw(m)
+				i += len(m) - 1
+				continue
+			}
+			prose += "@"
+
+		case c == ']' && strings.HasPrefix(rest, "]("):
+			// The target of a link
+			if k := matchParen(rest, 1); k > 0 {
+				raw(rest[:k+1])
+				i += k
+				continue
+			}
+			prose += "]"
+
+		case c == '<' && re_url.MatchString(rest[1:]):
+			u := re_url.FindString(rest[1:])
+			if strings.HasPrefix(rest[1+len(u):], ">") {
+				raw("\\url{" + u + "}")
+				i += len(u) + 1
+				continue
+			}
+			prose += "<"
+
+		case (c == 'h' || c == 'w') && (i == 0 || !isWordByte(s[i-1])) &&
+			re_url.MatchString(rest):
+			u := re_url.FindString(rest)
+			raw("\\url{" + u + "}")
+			i += len(u) - 1
+
+		case c == '{' && strings.HasPrefix(rest, "{{"):
+			if k := clozeEnd(rest); k > 2 {
+				hasClozes = true
+				raw("\\cloze{" + escapeText(rest[2:k]) + "}")
+				i += k + 1
+				continue
+			}
+			prose += "{"
+
+		case c == '^' && strings.HasPrefix(rest, "^["):
+			if k := matchBracket(rest, 1); k > 0 {
+				raw("\\footnote{" + escapeText(rest[2:k]) + "}")
+				i += k
+				continue
+			}
+			raw("\\textasciicircum{}")
+
+		case c == '^' || c == '~':
+			// Pandoc's superscripts and subscripts, e.g. x^2^ and H~2~O
+			if k := strings.IndexByte(rest[1:], c); k > 0 && !strings.ContainsAny(rest[1:k+1], " \t") {
+				cmd := map[byte]string{'^': "\\textsuperscript{", '~': "\\textsubscript{"}[c]
+				raw(cmd + escapeText(rest[1:k+1]) + "}")
+				i += k + 1
+				continue
+			}
+			raw(map[byte]string{'^': "\\textasciicircum{}", '~': "\\textasciitilde{}"}[c])
+
+		case c == '&' && envStack[0] == "tabular":
+			raw("&") // A column separator
+
+		default:
+			prose += s[i : i+1] // Not string(c), which would break up UTF-8
+		}
+	}
+	raw("")
+	return out
+}
+
+// The length of the TeX command (with its arguments) or escaped character
+// at the start of s, or 0 if the backslash stands alone.
+func texCommand(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
+	switch s[1] {
+	case '(', '[':
+		// Inline or display math
+		closing := map[byte]string{'(': "\\)", '[': "\\]"}[s[1]]
+		if k := strings.Index(s[2:], closing); k >= 0 {
+			return k + 4
+		}
+		return 0
+	}
+	if strings.IndexByte("\\#$%&_{}~^,;:!'\"`-/@|<>.=", s[1]) >= 0 {
+		return 2
+	}
+	n := 1
+	for n < len(s) && isLetter(s[n]) {
+		n++
+	}
+	if n == 1 {
+		return 0
+	}
+	if s[1:n] == "verb" && n < len(s) {
+		if k := strings.IndexByte(s[n+1:], s[n]); k >= 0 {
+			return n + k + 2
+		}
+	}
+	if n < len(s) && s[n] == '*' {
+		n++
+	}
+	// The arguments
+	for n < len(s) && (s[n] == '{' || s[n] == '[') {
+		k := matchBracket(s, n)
+		if k < 0 {
+			break
+		}
+		n = k + 1
+	}
+	return n
+}
+
+// Escapes the text in the arguments of a command, unless they aren't
+// text.
+func escapeArgs(cmd string) string {
+	n := 1
+	for n < len(cmd) && isLetter(cmd[n]) {
+		n++
+	}
+	name := cmd[1:n]
+	if n == 1 || rawArgs[strings.TrimSuffix(name, "*")] || name == "verb" {
+		return cmd
+	}
+	out := cmd[:n]
+	if name == "href" && n < len(cmd) && cmd[n] == '{' {
+		// The URL is raw, but the text isn't
+		k := matchBracket(cmd, n)
+		out, n = cmd[:k+1], k+1
+	}
+	for n < len(cmd) {
+		if cmd[n] != '{' {
+			// The star, or an optional argument
+			k := n
+			if cmd[n] == '[' {
+				k = matchBracket(cmd, n)
+			}
+			out += cmd[n : k+1]
+			n = k + 1
+			continue
+		}
+		k := matchBracket(cmd, n)
+		out += "{" + escapeText(cmd[n+1:k]) + "}"
+		n = k + 1
+	}
+	return out
+}
+
+// Returns the index of the bracket that closes the one at s[open] (which
+// is '{' or '['), skipping escaped ones, or -1.
+func matchBracket(s string, open int) int {
+	close := map[byte]byte{'{': '}', '[': ']'}[s[open]]
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[open]:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The index of the parenthesis that closes the one at s[open], or -1.
+func matchParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The length of the math at the start of s, or 0 if the dollar sign is
+// just a dollar sign.  As in Pandoc, the opening $ must be followed by a
+// non-space, and the closing $ preceded by one and not followed by a digit,
+// so that "$5 and $10" is money.
+func mathLength(s string) int {
+	if strings.HasPrefix(s, "$$") {
+		if k := strings.Index(s[2:], "$$"); k >= 0 {
+			return k + 4
+		}
+		return 0
+	}
+	if len(s) < 2 || s[1] == ' ' || s[1] == '\t' {
+		return 0
+	}
+	for j := 2; j < len(s); j++ {
+		if s[j] != '$' || s[j-1] == '\\' {
+			continue
+		}
+		if s[j-1] == ' ' || s[j-1] == '\t' {
+			continue
+		}
+		if j+1 < len(s) && s[j+1] >= '0' && s[j+1] <= '9' {
+			return 0
+		}
+		return j + 1
+	}
+	return 0
+}
+
+// Escapes inline code for \texttt, so that every character prints as
+// itself.
+func escapeCode(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\textbackslash{}", "{", "\\{", "}", "\\}", "#", "\\#",
+		"$", "\\$", "%", "\\%", "&", "\\&", "_", "\\_",
+		"~", "\\textasciitilde{}", "^", "\\textasciicircum{}",
+		"-", "-{}", "`", "\\textasciigrave{}", "'", "\\textquotesingle{}",
+		"\"", "\\textquotedbl{}", "<", "\\textless{}", ">", "\\textgreater{}",
+	).Replace(s)
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isWordByte(c byte) bool {
+	return isLetter(c) || c >= '0' && c <= '9' || c == '_'
+}
+
+func re_delim(delim string) string {
+	// Anything that isn't a delimiter between two delimiters.
+	s := `\` + delim + `([^\` + delim + `]+)\` + delim
+	//info(s)
+	return (s)
+}
+
+/*******************************************************************************
+*                                                                              *
+* Tables.  All four of Pandoc's table formats (simple, multiline, grid and     *
+* pipe) are parsed into a Table, which is then written out as a booktabs       *
+* tabular for TeX, and as Markdown (or HTML, if any cell holds block content   *
+* such as a list or an image) for the Markdown file.                           *
+*                                                                              *
+*******************************************************************************/
+
+// A table cell holds its source Markdown, one string per line.
+type Cell []string
+
+type Table struct {
+	Caption string
+	Aligns  []string  // "l", "c", "r", or "" for the default
+	Widths  []float64 // Relative column widths, if the format gives them
+	Header  []Cell    // nil if the table has no header row
+	Rows    [][]Cell
+	Split   int // Rows per slide: 0 for the default, -1 for never
+}
+
+var re_grid_border = regexp.MustCompile(`^\+(:?[-=]+:?\+)+\s*$`)
+var re_pipe_sep = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+var re_dashes = regexp.MustCompile(`^\s*-+(\s+-+)*\s*$`)
+var re_rule = regexp.MustCompile(`^-{3,}\s*$`)
+var re_caption = regexp.MustCompile(`^(Table)?:\s+(.*)$`)
+
+// Returns the caption on a line, if it is a table caption.  A bare ':'
+// caption is only allowed after a table, where it can't be mistaken for a
+// description list.
+func tableCaption(line string, colonOK bool) (string, bool) {
+	m := re_caption.FindStringSubmatch(line)
+	if m == nil || (m[1] == "" && !colonOK) {
+		return "", false
+	}
+	return strings.TrimSpace(m[2]), true
+}
+
+// Tries to parse a table (with an optional caption) starting at lines[i].
+// Returns the table and the number of lines it used, which is zero if
+// there's no table there.
+func parseTable(lines []string, i int) (Table, int) {
+	start := i
+	caption, before := tableCaption(lines[i], false)
+	if before {
+		for i++; i < len(lines) && !blank(lines[i]); i++ {
+			caption += " " + strings.TrimSpace(lines[i])
+		}
+		if i < len(lines) {
+			i++ // The blank line between caption and table
+		}
+		if i >= len(lines) {
+			return Table{}, 0
+		}
+	}
+
+	t, n := parseGridTable(lines, i)
+	if n == 0 {
+		t, n = parsePipeTable(lines, i)
+	}
+	if n == 0 {
+		t, n = parseMultilineTable(lines, i)
+	}
+	if n == 0 {
+		t, n = parseSimpleTable(lines, i)
+	}
+	if n == 0 {
+		return Table{}, 0
+	}
+	end := i + n
+
+	if !before {
+		// Look for a caption after the table, perhaps after a blank line
+		j := end
+		if j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+			j++
+		}
+		if j < len(lines) {
+			if c, ok := tableCaption(lines[j], true); ok {
+				caption = c
+				// A caption runs on to the next blank line
+				for end = j + 1; end < len(lines) && !blank(lines[end]); end++ {
+					caption += " " + strings.TrimSpace(lines[end])
+				}
+			}
+		}
+	}
+	caption, attrs := splitAttrs(caption)
+	t.Caption = caption
+	t.Split = splitOption(attrs["split"])
+	debug("(" + strconv.Itoa(line_number) + ") Found a table with " +
+		strconv.Itoa(len(t.Aligns)) + " columns and " +
+		strconv.Itoa(len(t.Rows)) + " rows")
+	return t, end - start
+}
+
+// Splits a trailing Pandoc attribute block, e.g. {#id .class key=value},
+// from some text, and returns the text and the attributes.  The identifier
+// is stored under "#", and classes under "." separated by spaces.
+func splitAttrs(s string) (string, map[string]string) {
+	attrs := map[string]string{}
+	m := regexp.MustCompile(`\s*\{([^{}]*)\}\s*$`).FindStringSubmatchIndex(s)
+	if m == nil {
+		return s, attrs
+	}
+	re_attr := regexp.MustCompile(`#([\w:.\-]+)|\.([\w\-]+)|([\w\-]+)=("[^"]*"|\S+)`)
+	for _, a := range re_attr.FindAllStringSubmatch(s[m[2]:m[3]], -1) {
+		switch {
+		case a[1] != "":
+			attrs["#"] = a[1]
+		case a[2] != "":
+			attrs["."] = strings.TrimSpace(attrs["."] + " " + a[2])
+		default:
+			attrs[a[3]] = strings.Trim(a[4], "\"")
+		}
+	}
+	return s[:m[0]], attrs
+}
+
+// Interprets a table's split option: a number of rows per slide, or "no".
+func splitOption(v string) int {
+	if v == "" {
+		return 0
+	}
+	if v == "no" || v == "false" {
+		return -1
+	}
+	n, e := strconv.Atoi(v)
+	if e != nil || n < 1 {
+		error("Bad split option for the table on line "+strconv.Itoa(line_number), v)
+		return 0
+	}
+	return n
+}
+
+// Returns the start and end (as rune offsets) of each run of dashes in a
+// line, e.g. the column markers of a simple or multiline table.
+func dashExtents(line []rune) [][2]int {
+	extents := [][2]int{}
+	for k := 0; k < len(line); k++ {
+		if line[k] == '-' {
+			e := k
+			for e < len(line) && line[e] == '-' {
+				e++
+			}
+			extents = appendAny(extents, [2]int{k, e})
+			k = e
+		}
+	}
+	return extents
+}
+
+// Returns the runes from a to b, clipped to the line.
+func runeSlice(line []rune, a, b int) string {
+	if a > len(line) {
+		a = len(line)
+	}
+	if b > len(line) || b < 0 {
+		b = len(line)
+	}
+	if a > b {
+		return ""
+	}
+	return string(line[a:b])
+}
+
+// Splits a line of a simple or multiline table into cells.  Text is
+// separated by runs of two or more spaces, and each chunk goes into the
+// column whose dashes it overlaps most, so text may overhang its column.
+func splitByExtents(line string, extents [][2]int) []string {
+	cells := make([]string, len(extents))
+	r := []rune(line)
+	re_chunk := regexp.MustCompile(`\S+( \S+)*`)
+	for _, m := range re_chunk.FindAllStringIndex(string(r), -1) {
+		// Convert byte offsets to rune offsets
+		a := len([]rune(line[:m[0]]))
+		b := len([]rune(line[:m[1]]))
+		best, most := 0, -1<<30
+		for j, e := range extents {
+			overlap := int(math.Min(float64(b), float64(e[1])) -
+				math.Max(float64(a), float64(e[0])))
+			if overlap > most {
+				best, most = j, overlap
+			}
+		}
+		if cells[best] != "" {
+			cells[best] += " "
+		}
+		cells[best] += line[m[0]:m[1]]
 	}
-	beamerOptions += fmt.Sprintf("\\institute{%s}\n", o.Affiliation)
-	beamerOptions += "\n\n"
+	return cells
+}
 
-	s := beamerOptions
+// Splits a line of a multiline table into cells at the start of each
+// column's dashes.
+func sliceByExtents(line string, extents [][2]int) []string {
+	cells := make([]string, len(extents))
+	r := []rune(line)
+	for j, e := range extents {
+		a, b := e[0], -1
+		if j == 0 {
+			a = 0
+		}
+		if j < len(extents)-1 {
+			b = extents[j+1][0]
+		}
+		cells[j] = strings.TrimSpace(runeSlice(r, a, b))
+	}
+	return cells
+}
 
-	s += makeCommon()
-	if o.Date != "" {
-		s += o.Date
+// Works out the alignment of a simple or multiline table column from the
+// position of the header text relative to the dashes below it.
+func extentAlign(line string, e [2]int) string {
+	r := []rune(line)
+	text := runeSlice(r, e[0], e[1])
+	if strings.TrimSpace(text) == "" {
+		return ""
 	}
-	s += o.slidesTeXPreamble
-	popEnvs()
-	s += strings.Join(slidesTeXlines, "") + "\\end{frame}\n\\end{document}\n"
+	left := e[0] >= len(r) || r[e[0]] != ' '
+	right := e[1]-1 < len(r) && e[1]-1 >= 0 && r[e[1]-1] != ' '
+	switch {
+	case left && right:
+		return ""
+	case left:
+		return "l"
+	case right:
+		return "r"
+	}
+	return "c"
+}
 
-	bits := strings.Split(f, ".")
-	f = strings.ToLower(bits[0])
-	f += "-slides"
-	o.SlidesFileName = f + ".tex"
-	writeOutput(o.SlidesFileName, s)
+// Relative widths from the lengths of the dash runs, including the gaps.
+func extentWidths(extents [][2]int) []float64 {
+	widths := make([]float64, len(extents))
+	total := float64(extents[len(extents)-1][1] - extents[0][0])
+	for j, e := range extents {
+		end := e[1]
+		if j < len(extents)-1 {
+			end = extents[j+1][0]
+		}
+		widths[j] = float64(end-e[0]) / total
+	}
+	return widths
+}
 
-	if run_TeX {
-		info("====> Formatting slides with TeX")
-		res := runTeX(f, "slides")
-		if res {
-			flist := f + ".log " + f + ".aux " +
-				f + ".out " + f + ".nav " + f + ".snm " +
-				f + ".toc " + f + ".run.xml " + f + ".bcf"
-			if o.hasCitations {
-				flist += f + ".bbl " + f + ".blg " + f + ".bcf"
-			}
-			cleanUp(flist)
-		} else {
-			info("Because of the previous error, I can't continue processing" +
-				" the slides.")
-			r <- false
+// Whether a line starts with one of the SN keys that can't begin a
+// table header, e.g. a section title.
+func isKeyLine(line string) bool {
+	key := strings.SplitN(line, " ", 2)[0]
+	switch key {
+	case "T", "X", "N", "D", "Z", "s", "i", "n", "d", "g", "p", "q", "t", "e":
+		return true
+	}
+	return strings.HasPrefix(key, "#") || regexp.MustCompile(`^\[\w+\]$`).MatchString(key)
+}
+
+func blank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func parseSimpleTable(lines []string, i int) (Table, int) {
+	t := Table{}
+	headerless := re_dashes.MatchString(lines[i])
+	d := i + 1
+	if headerless {
+		d = i
+	}
+	if blank(lines[i]) || d >= len(lines) || !re_dashes.MatchString(lines[d]) ||
+		(!headerless && isKeyLine(lines[i])) {
+		return t, 0
+	}
+	extents := dashExtents([]rune(lines[d]))
+	if len(extents) < 2 { // One column would be a Setext heading
+		return t, 0
+	}
+
+	k := d + 1
+	for ; k < len(lines) && !blank(lines[k]); k++ {
+		if re_dashes.MatchString(lines[k]) {
+			break
+		}
+		t.Rows = appendAny(t.Rows, cellsOf(splitByExtents(lines[k], extents)))
+	}
+	if headerless {
+		// A headerless table must end with a line of dashes
+		if k >= len(lines) || !re_dashes.MatchString(lines[k]) || len(t.Rows) == 0 {
+			return Table{}, 0
 		}
+		k++
+	} else if k < len(lines) && re_dashes.MatchString(lines[k]) {
+		k++ // An optional closing line of dashes
+	}
+	alignLine := ""
+	if headerless {
+		alignLine = lines[i+1]
 	} else {
-		debug("run_TeX is false!?!")
+		alignLine = lines[i]
+		t.Header = cellsOf(splitByExtents(lines[i], extents))
 	}
-	r <- true
+	t.Aligns = make([]string, len(extents))
+	for j, e := range extents {
+		t.Aligns[j] = extentAlign(alignLine, e)
+	}
+	return t, k - i
 }
 
-/*******************************************************************************
-*
-* This function writes the Markdown file then runs pandoc on it.
-*
-*******************************************************************************/
+func parseMultilineTable(lines []string, i int) (Table, int) {
+	t := Table{}
+	headerless := !re_rule.MatchString(lines[i])
+	if headerless && !re_dashes.MatchString(lines[i]) {
+		return t, 0
+	}
 
-func writeMD(filename string, r chan bool) {
-	mdYAML := "---\n"
-	notesTitle := fmt.Sprintf("title: %s %s (%s)\n",
-		o.CourseCode, o.CourseName, o.LectureTitle)
-	notesAuthor := fmt.Sprintf("author: %s", o.Author1)
-	if o.Author2 != "" {
-		notesAuthor += fmt.Sprintf("and %s", o.Author2)
+	// Find the line of dashes that marks the columns
+	d := i
+	if !headerless {
+		d = i + 1
+		for d < len(lines) && !blank(lines[d]) && !re_dashes.MatchString(lines[d]) {
+			d++
+		}
+		if d >= len(lines) || d == i+1 || !re_dashes.MatchString(lines[d]) {
+			return t, 0
+		}
 	}
-	notesTop := mdYAML + notesTitle + notesAuthor
-	if o.Date != "" {
-		d := regexp.MustCompile(`[^\{]+\{([^\}]+)\}`).ReplaceAllString(o.Date, "$1")
-		notesTop += "\ndate: " + d
+	extents := dashExtents([]rune(lines[d]))
+	if len(extents) < 2 && headerless {
+		return t, 0
 	}
-	notesTop = notesTop + "bibliography: /home/john/Dropbox/Writing/bib/all-refs.bib\n\n---\n\n"
 
-	popEnvs()
-	notesBottom := "# References"
-	s := notesTop + strings.Join(markdownLines, "") + notesBottom
-	// The MD code is done, now write it to a file and run the
-	// external tools on it
-	fs := strings.Split(filename, ".")
+	// Rows are separated by blank lines, and the table ends with a rule
+	rows := [][]string{}
+	row := []string{}
+	k := d + 1
+	for ; k < len(lines); k++ {
+		if re_rule.MatchString(lines[k]) || (headerless && re_dashes.MatchString(lines[k])) {
+			break
+		}
+		if blank(lines[k]) {
+			if len(row) > 0 {
+				rows = appendAny(rows, row)
+				row = []string{}
+			}
+			continue
+		}
+		row = append(row, lines[k])
+	}
+	if k >= len(lines) {
+		return Table{}, 0
+	}
+	if len(row) > 0 {
+		rows = appendAny(rows, row)
+	}
+	// Without blank lines between rows this is really a simple table
+	if len(rows) == 0 || (headerless && len(rows) == 1) {
+		return Table{}, 0
+	}
 
-	f := strings.ToLower(fs[0]) + "-notes"
-	f_m := f + ".md"
-	f_h := f + ".html"
-	//f_d := f + ".docx"
-	writeOutput(f_m, s)
-	args_h := []string{"--standalone", "--include-in-header=/home/john/Dropbox/Writing/snp/style.css", "--from=markdown+link_attributes+simple_tables+pipe_tables+definition_lists", "--filter=pandoc-citeproc", "--output=" + f_h, f_m}
-	args_d := []string{f_h, "--output=" + f_h}
+	joinCells := func(ls []string) []Cell {
+		cells := make([]Cell, len(extents))
+		for _, l := range ls {
+			for j, c := range sliceByExtents(l, extents) {
+				if c != "" {
+					cells[j] = Cell{strings.TrimSpace(strings.Join(cells[j], "") + " " + c)}
+				}
+			}
+		}
+		return cells
+	}
+	for _, r := range rows {
+		t.Rows = appendAny(t.Rows, joinCells(r))
+	}
 
-	res := true
-	info("====> Formatting notes with pandoc")
-	//info("pandoc " + strings.Join(args_h, " ") )
-	res = runProg("pandoc", args_h)
-	if res {
-		info("pandoc " + strings.Join(args_d, " ") )
-		res = runProg("pandoc", args_d)
-	} else {
-		//fmt.Printf("====> Error running pandoc.\n")
-		res = false
+	alignLine := rows[0][0]
+	if !headerless {
+		t.Header = joinCells(lines[i+1 : d])
+		alignLine = lines[i+1]
 	}
-	r <- res
+	t.Aligns = make([]string, len(extents))
+	for j, e := range extents {
+		t.Aligns[j] = extentAlign(alignLine, e)
+	}
+	t.Widths = extentWidths(extents)
+	return t, k + 1 - i
 }
 
-/*******************************************************************************
-*
-* This function calls the external tools to produce the PDF files.
-*
-*******************************************************************************/
-func runTeX(f string, ftype string) bool {
-	p := "pdflatex"
-	p = "xelatex"
-	a := []string{"-interaction=nonstopmode", f}
-	OK := false
-	if runProg(p, a) {
-		OK = true
-	} else {
-		if whichToKeep != ftype {
-			switch whichToKeep {
-			case "both":
-			case "notes":
-				whichToKeep = "both"
-			case "slides":
-				whichToKeep = "both"
-			default:
-				whichToKeep = ftype
+func parseGridTable(lines []string, i int) (Table, int) {
+	t := Table{}
+	if !re_grid_border.MatchString(lines[i]) {
+		return t, 0
+	}
+	top := []rune(strings.TrimRight(lines[i], " "))
+
+	// Column boundaries are the '+' signs in the top border
+	bounds := []int{}
+	for k, c := range top {
+		if c == '+' {
+			bounds = appendAny(bounds, k)
+		}
+	}
+	ncols := len(bounds) - 1
+
+	colAligns := func(border []rune) []string {
+		aligns := make([]string, ncols)
+		for j := 0; j < ncols; j++ {
+			l := bounds[j]+1 < len(border) && border[bounds[j]+1] == ':'
+			r := bounds[j+1]-1 < len(border) && border[bounds[j+1]-1] == ':'
+			switch {
+			case l && r:
+				aligns[j] = "c"
+			case l:
+				aligns[j] = "l"
+			case r:
+				aligns[j] = "r"
 			}
 		}
+		return aligns
 	}
 
-	if OK && o.hasCitations {
-		pb := "biber"
-		ab := []string{"--quiet", f}
-		runProg(pb, ab)
-		runProg(p, a)
-		cleanUp(f + ".bcf")
+	t.Aligns = colAligns(top)
+	t.Widths = make([]float64, ncols)
+	for j := 0; j < ncols; j++ {
+		t.Widths[j] = float64(bounds[j+1]-bounds[j]) / float64(bounds[ncols]-bounds[0])
 	}
 
-	if ftype == "notes" { // Produce the 2up version of the notes
-		n := baseName(o.NotesFileName)
-		f = n + "-2up.tex"
-		t := o.nupTop + "{" + n + ".pdf}\n" + o.nupBottom
-		writeOutput(f, t)
-		a = []string{"-interaction=nonstopmode", f}
-		runProg(p, a)
+	rows := [][]Cell{}
+	row := make([]Cell, ncols)
+	k := i + 1
+	for ; k < len(lines); k++ {
+		l := []rune(strings.TrimRight(lines[k], " "))
+		if len(l) == 0 || (l[0] != '|' && l[0] != '+') {
+			break
+		}
+		if l[0] == '+' {
+			if !re_grid_border.MatchString(string(l)) {
+				return Table{}, 0
+			}
+			rows = appendAny(rows, row)
+			row = make([]Cell, ncols)
+			if strings.Contains(string(l), "=") {
+				// The header separator, which also carries alignment
+				t.Header = rows[0]
+				rows = [][]Cell{}
+				t.Aligns = colAligns(l)
+			}
+			continue
+		}
+		for j := 0; j < ncols; j++ {
+			c := runeSlice(l, bounds[j]+1, bounds[j+1])
+			c = strings.TrimPrefix(strings.TrimRight(c, " "), " ")
+			row[j] = append(row[j], c)
+		}
+	}
+	if len(rows) == 0 && t.Header == nil {
+		return Table{}, 0
+	}
 
-		flist := n + "-2up.tex " + n + "-2up.aux " + n + "-2up.log "
-		cleanUp(flist)
+	// Trim blank lines from the top and bottom of each cell
+	trim := func(c Cell) Cell {
+		a, b := 0, len(c)
+		for a < b && blank(c[a]) {
+			a++
+		}
+		for b > a && blank(c[b-1]) {
+			b--
+		}
+		return c[a:b]
 	}
-	return true
+	for _, r := range rows {
+		for j := range r {
+			r[j] = trim(r[j])
+		}
+		t.Rows = appendAny(t.Rows, r)
+	}
+	for j := range t.Header {
+		t.Header[j] = trim(t.Header[j])
+	}
+	return t, k - i
 }
 
-/*******************************************************************************
-*                                                                              *
-* This function calls an external program with given arguments and a filename  *
-* to be processed                                                              *
-*                                                                              *
-*******************************************************************************/
-
-func runProg(p string, a []string) bool {
-	if Debug > 0 {
-		debug("\nRunning '" + p + "' '" + strings.Join(a, " ") + "'")
+// Splits a row of a pipe table at the pipes, ignoring escaped ones.
+func splitPipes(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = line[:len(line)-1]
 	}
+	cells := []string{}
+	cell := ""
+	for k := 0; k < len(line); k++ {
+		if line[k] == '\\' && k+1 < len(line) && line[k+1] == '|' {
+			cell += "|"
+			k++
+		} else if line[k] == '|' {
+			cells = append(cells, strings.TrimSpace(cell))
+			cell = ""
+		} else {
+			cell += string(line[k])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell))
+}
 
-	cmd := exec.Command(p, a...)
-	debug("====> About to exec " + p)
-	output, err := cmd.CombinedOutput()
-	debug("execing of " + p + " has completed\n")
-	if err != nil {
-		info(ErrorText + p + " did not complete successfully")
-		if Debug > 0 {
-			fmt.Println("Debug is:", Debug)
+func parsePipeTable(lines []string, i int) (Table, int) {
+	t := Table{}
+	if i+1 >= len(lines) || !strings.Contains(lines[i], "|") ||
+		!strings.Contains(lines[i+1], "|") || !re_pipe_sep.MatchString(lines[i+1]) {
+		return t, 0
+	}
+	seps := splitPipes(lines[i+1])
+	t.Aligns = make([]string, len(seps))
+	for j, sep := range seps {
+		l := strings.HasPrefix(sep, ":")
+		r := strings.HasSuffix(sep, ":")
+		switch {
+		case l && r:
+			t.Aligns[j] = "c"
+		case l:
+			t.Aligns[j] = "l"
+		case r:
+			t.Aligns[j] = "r"
 		}
-		if Debug > 0 {
-			info("Parameter to runProg p (program) is: " + p)
-			info("Parameter to runProg a (arg) is: " + strings.Join(a, " "))
-			fmt.Println("error message is: ", err)
-			fmt.Println("error info:", fmt.Sprint(err)+"\nStd out: "+string(output))
+	}
+
+	fit := func(cells []string) []Cell {
+		row := make([]Cell, len(seps))
+		for j := range row {
+			if j < len(cells) && cells[j] != "" {
+				row[j] = Cell{cells[j]}
+			}
 		}
-		return false
-	} else {
-		debug("Command '" + p + "' completed succesfully")
-		return true
+		return row
 	}
-}
 
-func baseName(s string) string {
-	fs := strings.Split(s, ".")
-	return strings.ToLower(fs[0])
+	// An empty header row means the table has no header
+	header := splitPipes(lines[i])
+	if strings.Trim(strings.Join(header, ""), " ") != "" {
+		t.Header = fit(header)
+	}
+	k := i + 2
+	for ; k < len(lines) && !blank(lines[k]) && strings.Contains(lines[k], "|"); k++ {
+		t.Rows = appendAny(t.Rows, fit(splitPipes(lines[k])))
+	}
+	return t, k - i
 }
 
-/*******************************************************************************
-*                                                                              *
-* This function removes a list of files given in a string with filenames       *
-* separated by spaces                                                          *
-*                                                                              *
-*******************************************************************************/
-func cleanUp(files string) {
-	flist := strings.Fields(files)
-	for i := 0; i < len(flist); i++ {
-		exists, _ := fileExists(flist[i], "")
-		if exists {
-			err := os.Remove(flist[i])
+func cellsOf(texts []string) []Cell {
+	cells := make([]Cell, len(texts))
+	for j, c := range texts {
+		if c != "" {
+			cells[j] = Cell{c}
+		}
+	}
+	return cells
+}
 
-			if err == nil {
-				if Debug > 2 {
-					info("Successfully removed " + files)
-				}
-			} else {
-				fmt.Println("Error removing files: ", err)
+// Whether any cell holds more than a line of inline text.
+func (t Table) hasBlocks() bool {
+	rows := appendAny([][]Cell{t.Header}, t.Rows...)
+	for _, r := range rows {
+		for _, c := range r {
+			if len(c) > 1 {
+				return true
+			}
+			if len(c) == 1 && (re_cell_item.MatchString(c[0]) ||
+				re_cell_image.MatchString(c[0])) {
+				return true
 			}
 		}
 	}
+	return false
 }
 
+var re_cell_item = regexp.MustCompile(`^\s*([-*+]|\d+\.)\s+(.*)$`)
+var re_cell_image = regexp.MustCompile(`^\s*!\[([^\]]*)\]\(([^)\s]+)\)`)
+
 /*******************************************************************************
 *                                                                              *
-* This function checks for the existence of a file                             *
+* Data files.  "csv [options] file" loads a CSV or TSV file as a table, so     *
+* that the notes and slides keep up with the data.  The options are:           *
+*                                                                              *
+*   cols=1,3-4 or cols=Name,Mark   columns to show, by number or header        *
+*   header=no                      the first row is data, not a header         *
+*   skip=N                         ignore the first N lines of the file        *
+*   limit=N                        show at most N rows                         *
+*   align=lrc                      column alignment (default: numbers right)   *
+*   sep=tab|comma|semicolon        field separator (default: from extension)   *
+*   caption="..."                  the table caption                           *
+*   split=N or split=no            rows per slide before continuing the table  *
 *                                                                              *
 *******************************************************************************/
-func fileExists(filename string, t string) (bool, uint64) {
-	graphicsTypes := []string{"", ".pdf", ".jpg", ".jpeg", ".png"}
-	found := false
-	f := filename
-	s, _ := os.Stat(f)
-
-	if t == "graphics" {
-		for i := range graphicsTypes {
-			f = filename + graphicsTypes[i]
-			stat, err := os.Stat(f)
-			if err == nil {
-				found = true
-				s = stat
-				break
-			}
-		}
-	} else {
-		stat, err := os.Stat(filename)
-		if err == nil {
-			found = true
-			s = stat
+func loadCSV(v string) Table {
+	opts := map[string]string{"header": "yes", "align": "auto"}
+	f := strings.TrimSpace(v)
+	if strings.HasPrefix(f, "[") && strings.Contains(f, "]") {
+		re_opt := regexp.MustCompile(`(\w+)=("[^"]*"|[^\s\]]+)`)
+		for _, m := range re_opt.FindAllStringSubmatch(substr(f, "[", "]", false), -1) {
+			opts[m[1]] = strings.Trim(m[2], "\"")
 		}
+		f = substr(f, "]", "", false)
+	}
+
+	found, size := fileExists(f, "")
+	if !found {
+		abort("Data file " + f + " (line " + strconv.Itoa(line_number) + ") does not exist")
 	}
+	fileSizes[f] = size
+	totalSize += size
 
-	if found {
-		return true, uint64(s.Size())
-	} else {
-		return false, uint64(0)
+	sep := opts["sep"]
+	if sep == "" && strings.ToLower(filepath.Ext(f)) == ".tsv" {
+		sep = "tab"
+	}
+	comma := map[string]rune{"": ',', "comma": ',', "tab": '\t', "semicolon": ';'}[sep]
+	if comma == 0 {
+		abort("Unknown separator for " + f + ": " + sep)
 	}
-	return found, uint64(0)
-}
-
-func strElide(s string, l int) string {
-	end := math.Min(float64(len(s)), float64(l))
-	e := int(end)
-	return (s[0:e])
-}
 
-func readConf(filename string) bool {
-	o.Date = ""
-	o.hasCitations = false
-	o.Indent = 0
+	fi, err := os.Open(f)
+	if err != nil {
+		abort("Can't read data file " + f + ": " + err.Error())
+	}
+	defer fi.Close()
+	r := csv.NewReader(fi)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		abort("Can't parse data file " + f + ": " + err.Error())
+	}
 
-	if Debug > 0 {
-		info("Reading configuration from files in '" +
-			confLocation + "'")
+	if n, e := strconv.Atoi(opts["skip"]); e == nil && n > 0 {
+		if n > len(records) {
+			n = len(records)
+		}
+		records = records[n:]
+	}
+	if len(records) == 0 {
+		abort("Data file " + f + " is empty")
 	}
 
-	contents := readInput(confLocation + filename)
-	key := ""
-	val := ""
+	var header []string
+	if opts["header"] != "no" {
+		header = records[0]
+		records = records[1:]
+	}
 
-	for i := range contents {
-		if contents[i] == "" {
-			break
+	// Work out which columns to keep
+	width := len(header)
+	for _, rec := range records {
+		if len(rec) > width {
+			width = len(rec)
 		}
-		keyval := strings.Split(contents[i], " = ")
-		key = strings.Trim(keyval[0], " ")
-		val = strings.Trim(keyval[1], " ")
-		// Handle sn comment lines
-		if strings.HasPrefix(key, "#") {
-			key = "#"
+	}
+	cols := []int{}
+	if opts["cols"] == "" {
+		for c := 0; c < width; c++ {
+			cols = appendAny(cols, c)
 		}
-
-		switch key {
-		case "Author1":
-			o.Author1 = val
-		case "Author2":
-			o.Author2 = val
-		case "Affiliation":
-			o.Affiliation = val
-		case "Email1":
-			o.Email1 = val
-		case "Email2":
-			o.Email2 = val
-		case "ErrorText":
-			ErrorText = val
-		case "Tab":
-			o.Tab, _ = strconv.Atoi(val)
-		case "Indent":
-			o.Indent, _ = strconv.Atoi(val)
-		case "bold":
-			o.bold = val
-		case "italic":
-			o.italic = val
-		case "#":
-		default:
-			error("No match for key in snp.ini! Key is: "+key, "")
+	} else {
+		for _, c := range strings.Split(opts["cols"], ",") {
+			cols = appendAny(cols, csvColumns(c, header, width, f)...)
 		}
 	}
 
-	TeXOptions := readInput(confLocation + "TeXOptions")
-	lines := ""
-	curKey := ""
-	prevKey := ""
-	for i := range TeXOptions {
-		tokens := strings.Split(TeXOptions[i], ":")
-		if len(tokens) > 1 {
-			curKey = strings.Trim(tokens[0], " ")
-			switch prevKey {
-			case "TeXBeginDocument":
-				o.TeXBeginDocument = lines
-			case "TeXPreambleCommon":
-				o.TeXPreambleCommon = lines
-			case "notesTeXPreamble":
-				o.notesTeXPreamble = lines
-			case "notesTeXBeginDocument":
-				o.notesTeXBeginDoc = lines
-			case "slidesTeXPreamble":
-				o.slidesTeXPreamble = lines
-			case "slidesTeXBeginDoc":
-				o.slidesTeXBeginDoc = lines
-			case "nupTop":
-				o.nupTop = strings.TrimSpace(lines)
-			case "nupBottom":
-				o.nupBottom = lines
+	if n, e := strconv.Atoi(opts["limit"]); e == nil && n < 0 {
+		error("The limit for "+f+" (line "+strconv.Itoa(line_number)+") can't be negative",
+			"ignoring it")
+	} else if e == nil && n < len(records) {
+		info("Showing " + strconv.Itoa(n) + " of the " + strconv.Itoa(len(records)) +
+			" rows in " + f)
+		records = records[:n]
+	}
+
+	pick := func(rec []string) []Cell {
+		cells := make([]Cell, len(cols))
+		for j, c := range cols {
+			if c < len(rec) && strings.TrimSpace(rec[c]) != "" {
+				cells[j] = Cell{strings.TrimSpace(rec[c])}
 			}
-			lines = ""
-		} else {
-			prevKey = curKey
-			lines += tokens[0] + "\n"
 		}
+		return cells
 	}
-	return true
-}
 
-/************************************************************************
-* Returns string between two delimiters, optionally including the       *
-* delimeters themselves.  If the end string is "", returns from the     *
-* start delimiter to the end of the input string                        *
-************************************************************************/
-func substr(s, start, end string, id bool) string {
-	x := strings.Index(s, start)
-	y := 0
+	t := Table{Caption: opts["caption"], Split: splitOption(opts["split"])}
+	if header != nil {
+		t.Header = pick(header)
+	}
+	for _, rec := range records {
+		t.Rows = appendAny(t.Rows, pick(rec))
+	}
 
-	if end == "" {
-		y = len(s)
+	t.Aligns = make([]string, len(cols))
+	if opts["align"] == "auto" {
+		for j := range cols {
+			if numericColumn(t.Rows, j) {
+				t.Aligns[j] = "r"
+			}
+		}
 	} else {
-		y = strings.Index(s, end)
+		for j, a := range opts["align"] {
+			if j < len(t.Aligns) && strings.ContainsRune("lcr", a) {
+				t.Aligns[j] = string(a)
+			}
+		}
 	}
-	var ss string
+	debug("Loaded " + strconv.Itoa(len(t.Rows)) + " rows from " + f)
+	return t
+}
 
-	if id { // id = "include delimiters"
-		ss = s[x : y+1]
-	} else {
-		ss = s[x+1 : y]
+// Converts one item of a cols= option, e.g. "3", "2-4" or "Mark", to
+// zero-based column numbers.
+func csvColumns(c string, header []string, width int, f string) []int {
+	c = strings.TrimSpace(c)
+	if m := regexp.MustCompile(`^(\d+)-(\d+)$`).FindStringSubmatch(c); m != nil {
+		a, _ := strconv.Atoi(m[1])
+		b, _ := strconv.Atoi(m[2])
+		if a < 1 || b > width || a > b {
+			abort("Column range " + c + " is outside " + f)
+		}
+		cols := []int{}
+		for k := a; k <= b; k++ {
+			cols = appendAny(cols, k-1)
+		}
+		return cols
 	}
-	if Debug > 2 {
-		info("Substring of '" + s + "' delimited by '" +
-			start + "' and '" + end + "' is '" + ss + "'")
+	if n, e := strconv.Atoi(c); e == nil {
+		if n < 1 || n > width {
+			abort("Column " + c + " is outside " + f)
+		}
+		return []int{n - 1}
 	}
-	return strings.TrimSpace(ss)
+	for k, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), c) {
+			return []int{k}
+		}
+	}
+	abort("No column called '" + c + "' in " + f)
+	return nil
 }
 
-func tc(part, pars string) {
-	// Mimics a two-column table by laying out two minipages side-by side. Use the height field to stop the minipages floating over text.
-	parv := strings.Split(pars, " ") // Minipage height + width of left column
-
-	switch part {
-	case "begin":
-		// FIXME: check that values are integer and float
-		mp_h = strings.TrimSpace(parv[1])
-		col_1_w := strings.TrimSpace(parv[0])
-		w, e := strconv.ParseFloat(col_1_w, 2)
-		if e != nil {
-			//FIXME: use the error code!
-			error("Error:", "How to convert error object to string?")
+// Whether every non-empty cell in a column is a number (allowing for
+// thousands separators, currency and percentages).
+func numericColumn(rows [][]Cell, j int) bool {
+	re_num := regexp.MustCompile(`^[-+]?[$£€]?[\d,]*\.?\d+%?$`)
+	found := false
+	for _, r := range rows {
+		if j >= len(r) || r[j] == nil {
+			continue
 		}
-		col_2_w = strconv.FormatFloat(1-w-0.10, 'f', 2, 64) // WTF?
-		//info("Column widths are " + col_1_w + " and " + col_2_w + "; height: " + mp_h)
-
-		addTeXlines("   \\begin{minipage}[b][" + mp_h + "cm][t]{" + col_1_w + "\\linewidth}\n")
-	case "split":
-		//info("Split of two-column layout")
-		addTeXlines(" \\end{minipage}\n")
-		addTeXlines("   \\begin{minipage}[b][" + mp_h + "cm][t]{" + col_2_w + "\\linewidth}\n")
-	case "end":
-		//info("End two-column layout")
-		addTeXlines(" \\end{minipage}\n\n")
+		if !re_num.MatchString(r[j][0]) {
+			return false
+		}
+		found = true
 	}
+	return found
 }
 
-func parseCitations(line string) string {
-	re := regexp.MustCompile("@(\\w+)")
-	cites := re.FindAllString(line, -1)
-	debug("Found citation keys:" + strings.Join(cites, " "))
-	s := strings.Join(cites, ",")
-	re = regexp.MustCompile("@")
-	s = re.ReplaceAllString(s, "")
-	debug("Returning " + s)
-	return (s)
-}
+/*******************************************************************************
+* Table output                                                                 *
+*******************************************************************************/
 
-func append(slice []string, element string) []string {
-	n := len(slice)
-	if n == cap(slice) {
-		// Slice is full; must grow.
-		// We double its size and add 1, so if the size is zero we still grow.
-		newSlice := make([]string, len(slice), 2*len(slice)+1)
-		copy(newSlice, slice)
-		slice = newSlice
+// Writes a table to the notes, slides and Markdown file.
+func emitTable(t Table) {
+	md_skip = true
+	popEnvs()
+	addMDlines(tableMD(t))
+	notes, slides := "", ""
+	if !SlidesOnly {
+		notes = tableTeX(t, false)
 	}
-	slice = slice[0 : n+1]
-	slice[n] = element
-	return slice
+	if !NotesOnly {
+		slides = tableTeX(t, true)
+	}
+	addNotesSlides(notes, slides)
 }
 
-func smart_punc(line string) string {
-	// "Smart" punctuation, i.e. handling quotation marks,
-	// ellipses, percentage signs and ampersands in the TeX-safe
-	// way.
-	// "Smart" punctuation, i.e. translate to TeX and escape TeX
-	re_el := regexp.MustCompile(`\.\.\.`) // ellipsis
-	line = re_el.ReplaceAllString(line, "\\ldots")
+// The LaTeX for a cell.  Lists and images are only possible in cells of
+// tables whose columns have a width (i.e. grid and multiline tables).
+func cellTeX(c Cell) string {
+	s := ""
+	list := ""
+	closeList := func() {
+		if list != "" {
+			s += "\\end{" + list + "}"
+			list = ""
+		}
+	}
+	for _, l := range c {
+		if blank(l) {
+			closeList()
+			if s != "" {
+				s += "\\par "
+			}
+			continue
+		}
+		if m := re_cell_image.FindStringSubmatch(l); m != nil {
+			closeList()
+			s += "\\includegraphics[width=\\linewidth]{" + imageFor(m[2], "tex") + "}"
+			continue
+		}
+		if m := re_cell_item.FindStringSubmatch(l); m != nil {
+			env := "itemize"
+			if m[1][0] >= '0' && m[1][0] <= '9' {
+				env = "enumerate"
+			}
+			if list != env {
+				closeList()
+				list = env
+				s += "\\begin{" + env + "}"
+			}
+			s += "\\item " + process_md(m[2]) + " "
+			continue
+		}
+		if list != "" && strings.HasPrefix(l, "  ") {
+			s += process_md(strings.TrimSpace(l)) + " " // A continued item
+			continue
+		}
+		closeList()
+		s += process_md(strings.TrimSpace(l)) + " "
+	}
+	closeList()
+	return strings.TrimSpace(s)
+}
 
-	re_qo := regexp.MustCompile("([\\s\\(])\"") // open quotation mark
-	line = re_qo.ReplaceAllString(line, "$1``")
+// The LaTeX for a table.  Long tables become longtables in the notes, and
+// carry on over extra frames, with the header repeated, on the slides.
+func tableTeX(t Table, slides bool) string {
+	if t.Widths == nil && t.hasBlocks() {
+		// Block content needs paragraph columns, so share the width out
+		t.Widths = make([]float64, len(t.Aligns))
+		for j := range t.Widths {
+			t.Widths[j] = 1 / float64(len(t.Widths))
+		}
+	}
+	colspec := ""
+	for j, a := range t.Aligns {
+		if t.Widths != nil {
+			// A paragraph column, with the alignment done by hand
+			usePackage("array")
+			ragged := map[string]string{"": "\\raggedright", "l": "\\raggedright",
+				"c": "\\centering", "r": "\\raggedleft"}[a]
+			colspec += ">{" + ragged + "\\arraybackslash}p{" +
+				strconv.FormatFloat(t.Widths[j]*0.9, 'f', 3, 64) + "\\linewidth}"
+		} else if a == "" {
+			colspec += "l"
+		} else {
+			colspec += a
+		}
+	}
 
-	re_qc := regexp.MustCompile("([^\"])\"") // close quotation mark
-	line = re_qc.ReplaceAllString(line, "$1''")
+	row := func(cells []Cell) string {
+		r := make([]string, len(cells))
+		for j, c := range cells {
+			r[j] = cellTeX(c)
+		}
+		return strings.Join(r, " & ") + " \\\\\n"
+	}
+	header := "\\toprule\n"
+	if t.Header != nil {
+		header += row(t.Header) + "\\midrule\n"
+	}
+	body := make([]string, len(t.Rows))
+	for k, r := range t.Rows {
+		body[k] = row(r)
+	}
 
-	re_pc := regexp.MustCompile("(\\d|\\?)\\%") // escape '%'. FIXME: match anywhere except start of line.
-	line = re_pc.ReplaceAllString(line, "$1\\%")
+	if !slides && (t.Split > 0 || (t.Split == 0 && o.longTableRows > 0 &&
+		len(t.Rows) > o.longTableRows)) {
+		usePackage("longtable")
+		s := "\\begin{longtable}{" + colspec + "}\n"
+		if t.Caption != "" {
+			s += "\\caption{" + process_md(t.Caption) + "}\\\\\n"
+		}
+		s += header + "\\endfirsthead\n" +
+			header + "\\endhead\n" +
+			"\\midrule\n\\multicolumn{" + strconv.Itoa(len(t.Aligns)) +
+			"}{r}{\\emph{continued}}\\\\\n\\endfoot\n" +
+			"\\bottomrule\n\\endlastfoot\n"
+		return s + strings.Join(body, "") + "\\end{longtable}\n"
+	}
 
-	re_ss := regexp.MustCompile(re_delim("^")) // Superscript (in-text)
-	line = re_ss.ReplaceAllString(line, "\\textsuperscript{$1}")
+	begin := "\\begin{center}\n"
+	end := "\\end{center}\n"
+	if t.Caption != "" {
+		begin = "\\begin{table}[htbp]\n\\centering\n\\caption{" + process_md(t.Caption) + "}\n"
+		end = "\\end{table}\n"
+	}
+	tabular := "\\begin{tabular}{" + colspec + "}\n" + header
+
+	// How many rows fit on a slide?
+	n := len(body)
+	if slides {
+		if t.Split > 0 {
+			n = t.Split
+		} else if t.Split == 0 && o.slideTableRows > 0 {
+			n = o.slideTableRows
+		}
+		if n < len(body) && !canSplitFrame("table") {
+			n = len(body)
+		}
+	}
 
-	//re_dol := regexp.MustCompile("\\$(?P<amt>\\d+(\\.\\d{2}))*[\\s\\.][^\\$]")   // escape $
-	re_dol := regexp.MustCompile(`\$(\d)`) // escape $
-	if re_dol.FindStringIndex(line) != nil {
-		debug("Found $: " + line)
-		line = re_dol.ReplaceAllString(line, "\\$$1")
+	s := begin + tabular
+	for k := range body {
+		if k > 0 && k%n == 0 {
+			// Carry on in a new frame, with the header repeated
+			slidesCount++
+			s += "\\bottomrule\n\\end{tabular}\n" + end +
+				"\\end{frame}\n\n\\begin{frame}" + frame_style +
+				"\\frametitle{" + strings.TrimSpace(frame_title) + " (cont.)}\n" +
+				"\\begin{center}\n" + tabular
+			end = "\\end{center}\n"
+		}
+		s += body[k]
 	}
+	return s + "\\bottomrule\n\\end{tabular}\n" + end
+}
 
-	re_frac := regexp.MustCompile(` (\d+)/(\d+) `) // TeX-ify fraction
-	line = re_frac.ReplaceAllString(line, "$\\frac{$1}{2}$")
+// Whether the frame can be ended here and carried on in another.  Not in
+// columns or an exercise's block, which would be left open across frames.
+func canSplitFrame(what string) bool {
+	open := ""
+	if columns.Open {
+		open = "columns"
+	}
+	for _, d := range divStack {
+		if d.Kind == "exercise" {
+			open = "an exercise"
+		}
+	}
+	if open == "" {
+		return true
+	}
+	warn("the " + what + " on line " + strconv.Itoa(line_number) + " is in " + open +
+		", so it isn't split across slides")
+	return false
+}
 
-	re_amp := regexp.MustCompile("\\&")  // escape &  FIXME: breaks math array environment!
-	re_uri := regexp.MustCompile("http") // detect URI
-	if re_amp.FindStringIndex(line) != nil && re_uri.FindStringIndex(line) == nil {
-		if envStack[0] != "tabular" && leave_alone != true { // Or array?
-			debug("Current environment: " + envStack[0])
-			line = re_amp.ReplaceAllString(line, " \\& ")
+// Tables with only inline content become pipe tables in the Markdown file;
+// anything else becomes an HTML table, which Pandoc passes straight through.
+func tableMD(t Table) string {
+	if t.hasBlocks() {
+		return "\n" + tableHTML(t) + "\n"
+	}
+	row := func(cells []Cell) string {
+		r := make([]string, len(t.Aligns))
+		for j := range r {
+			if j < len(cells) {
+				r[j] = strings.Replace(strings.Join(cells[j], " "), "|", "\\|", -1)
+			}
 		}
+		return "| " + strings.Join(r, " | ") + " |\n"
 	}
-	return (line)
+
+	s := "\n"
+	if t.Header != nil {
+		s += row(t.Header)
+	} else {
+		s += row(make([]Cell, len(t.Aligns)))
+	}
+	seps := make([]string, len(t.Aligns))
+	for j, a := range t.Aligns {
+		seps[j] = map[string]string{"": "---", "l": ":--", "c": ":-:", "r": "--:"}[a]
+	}
+	s += "|" + strings.Join(seps, "|") + "|\n"
+	for _, r := range t.Rows {
+		s += row(r)
+	}
+	if t.Caption != "" {
+		s += "\nTable: " + t.Caption + "\n"
+	}
+	return s + "\n"
 }
 
-func re_delim(delim string) string {
-	// Anything that isn't a delimiter between two delimiters.
-	s := `\` + delim + `([^\` + delim + `]+)\` + delim
-	//info(s)
-	return (s)
+func tableHTML(t Table) string {
+	cell := func(tag string, j int, c Cell) string {
+		style := ""
+		if a := t.Aligns[j]; a != "" {
+			style = " style=\"text-align: " +
+				map[string]string{"l": "left", "c": "center", "r": "right"}[a] + ";\""
+		}
+		return "<" + tag + style + ">" + cellHTML(c) + "</" + tag + ">"
+	}
+
+	s := "<table>\n"
+	if t.Caption != "" {
+		s += "<caption>" + inlineHTML(t.Caption) + "</caption>\n"
+	}
+	if t.Widths != nil {
+		s += "<colgroup>\n"
+		for _, w := range t.Widths {
+			s += "<col style=\"width: " + strconv.FormatFloat(w*100, 'f', 0, 64) + "%\">\n"
+		}
+		s += "</colgroup>\n"
+	}
+	if t.Header != nil {
+		s += "<thead>\n<tr>"
+		for j, c := range t.Header {
+			s += cell("th", j, c)
+		}
+		s += "</tr>\n</thead>\n"
+	}
+	s += "<tbody>\n"
+	for _, r := range t.Rows {
+		s += "<tr>"
+		for j, c := range r {
+			s += cell("td", j, c)
+		}
+		s += "</tr>\n"
+	}
+	return s + "</tbody>\n</table>\n"
 }
 
-func makeColspec(cols [][]string) string {
-	colspec := "[t]{"
-	//info("Cols: ")
-	//fmt.Printf("%v",cols)
-	//info("\n")
-	for _, col := range cols {
-		if regexp.MustCompile(`:-`).FindStringIndex(col[0]) != nil {
-			colspec = colspec + " l"
-		} else if regexp.MustCompile(`-:`).FindStringIndex(col[0]) != nil {
-			colspec = colspec + " r"
-		} else {
-			colspec = colspec + " l"
-		}
-	}
-	colspec = colspec + " }"
-	return (colspec)
-}
-
-func processTables(line string) string {
-	// Process Markdown tables, both simple and pipe.
-	// Detect different types of Pandoc tables
-	// Difficult because a line of dashes indicates a table, but
-	// the header information is in the previous line. Also, have
-	// to discard the line that contains the dashes!
-	re_simp := regexp.MustCompile(`(:*-{2,}:*)\s+`)
-	re_pipe := regexp.MustCompile(`^\|`)
-	re_blok := regexp.MustCompile(`^\+\-`)
-
-	line += " "
-	cols := [][]string{}
-	if re_simp.FindStringIndex(line) != nil {
-		info("Found simple table!")
-		table_type = "simple"
-		cols = re_simp.FindAllStringSubmatch(line, -1)
-	} else if re_pipe.FindStringIndex(line) != nil && table_type != "block" {
-		info("Found pipe table!")
-		table_type = "pipe"
-		cols = regexp.MustCompile(`\|`).FindAllStringSubmatch(line, -1)
-	} else if re_blok.FindStringIndex(line) != nil {
-		// Could be the first OR last line of the table
-		if table_type == "block" {
-			info(strconv.Itoa(line_number) + ": End of block table")
-			table_type = "none"
-		} else {
-			info(strconv.Itoa(line_number) + ": Found block table")
-			table_type = "block"
-			cols = regexp.MustCompile(`\+`).FindAllStringSubmatch(line, -1)
+// The HTML for a cell, which may hold paragraphs, lists and images.
+func cellHTML(c Cell) string {
+	s := ""
+	list := ""
+	closeList := func() {
+		if list != "" {
+			s += "</" + list + ">"
+			list = ""
 		}
 	}
-	cols_n := len(cols)
-	if cols_n > 0 {
-		in_table = true
-		info("Found table with " + strconv.Itoa(len(cols)) + " columns")
-		debug(line)
-		colspec := makeColspec(cols)
-		info("colspec: " + colspec)
-		has_header := false
-
-		// Remove the previous line from the TeX output file, because we need
-		// to re-process it. FIXME: true for simple, what about pipe and block?
-		header := ""
-		if table_type == "simple" {
-			header = smart_punc(lines[line_number-2])
-			notesTeXlines[len(notesTeXlines)-1] = ""
-			slidesTeXlines[len(slidesTeXlines)-1] = ""
-			debug("header:" + header)
-		} else {
-			// The header of a pipe or block table may be empty
-			if regexp.MustCompile(`^[\|\s]+$`).FindStringIndex(lines[line_number]) == nil {
-				header = smart_punc(lines[line_number])
-			} else {
-				debug("Blank header line in pipe table")
-				header = ""
+	for _, l := range c {
+		if blank(l) {
+			closeList()
+			continue
+		}
+		if m := re_cell_item.FindStringSubmatch(l); m != nil {
+			tag := "ul"
+			if m[1][0] >= '0' && m[1][0] <= '9' {
+				tag = "ol"
 			}
+			if list != tag {
+				closeList()
+				list = tag
+				s += "<" + tag + ">"
+			}
+			s += "<li>" + inlineHTML(m[2]) + "</li>"
+			continue
 		}
+		closeList()
+		s += inlineHTML(strings.TrimSpace(l)) + " "
+	}
+	closeList()
+	return strings.TrimSpace(s)
+}
 
-		if header != "" {
-			has_header = true
-		} else {
-			has_header = false
-		}
+// Converts inline Markdown (emphasis, code, links and images) to HTML.
+func inlineHTML(s string) string {
+	s = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+	s = regexp.MustCompile("`([^`]+)`").ReplaceAllString(s, "<code>$1</code>")
+	re_img := regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	s = re_img.ReplaceAllStringFunc(s, func(img string) string {
+		m := re_img.FindStringSubmatch(img)
+		return `<img src="` + imageFor(m[2], "html") + `" alt="` + m[1] +
+			`" style="max-width: 100%;">`
+	})
+	s = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`).ReplaceAllString(s, `<a href="$2">$1</a>`)
+	s = regexp.MustCompile(`\*\*([^*]+)\*\*`).ReplaceAllString(s, "<strong>$1</strong>")
+	s = regexp.MustCompile(`\*([^*]+)\*`).ReplaceAllString(s, "<em>$1</em>")
+	return s
+}
 
-		pushEnv("tabular", colspec)
-		if has_header {
-			if table_type == "simple" {
-				// FIXME: adds extra & at end of line (?)
-				header = regexp.MustCompile(`\s{2,}`).ReplaceAllString(header, " & ")
-			} else if table_type == "pipe" {
-				header = regexp.MustCompile(`\|`).ReplaceAllString(header, " & ")
-			} else if table_type == "block" {
-				header = regexp.MustCompile(`[\|]`).ReplaceAllString(header, " & ")
-			}
+// Adds a package to the common preamble, unless it is already there.
+func usePackage(pkg string) {
+	if !strings.Contains(o.TeXPreambleCommon, "{"+pkg+"}") {
+		o.TeXPreambleCommon += "\n\\usepackage{" + pkg + "}\n"
+	}
+}
 
-			addTeXlines(header)
-			addTeXlines("\\\\\n\\midrule\n")
+// Converts images in the middle of a line to \includegraphics.  (Images
+// on a line of their own are figures: see parseImageLine.)  Inline images
+// appear the same in the notes and slides.
+func inlineImages(line string) string {
+	re_g := regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)(\{[^}]*\})?`)
+	return re_g.ReplaceAllStringFunc(line, func(img string) string {
+		m := re_g.FindStringSubmatch(img)
+		_, attrs := splitAttrs(m[3])
+		f := Figure{}
+		imageAttrs(&f, attrs)
+		args := graphicsArgs(f.Notes)
+		if args != graphicsArgs(f.Slides) || f.Notes.Align != "" {
+			warn("inline images look the same in the notes and slides; " +
+				"put the image on a line of its own (line " + strconv.Itoa(line_number) + ")")
 		}
-		// Now discard the line with --- indicating the table
-		debug("Discarding line: " + line)
-		line = "%" // Can't replace with a blank line: it will end the table env.
-	} else if in_table {
-		if regexp.MustCompile(`:-|-:`).FindStringIndex(line) != nil {
-			//info("Found pipe table column specification: '" + line + "'")
-			line = "%"
+		if args != "" {
+			args = "[" + args + "]"
 		}
-		debug("The subsequent lines are: " + line )
-	}
-	return(line)
+		return "\\includegraphics" + args + "{" + imageFor(m[2], "tex") + "}"
+	})
 }
 
 func process_md(line string) string {
-	line = smart_punc(line)
+	line = inlineFootnotes(line)
+	line = inlineImages(line)
+	line = escapeTeX(line)
 	// Set up regular expressions for line parsing
 	match_string := `([^\` + o.bold + `]+)`
 	bold_re := `\` + o.bold + `{2}` + match_string + `\` + o.bold + `{2}`
@@ -1732,15 +6931,12 @@ func process_md(line string) string {
 	re_i := regexp.MustCompile(ital_re) // italics
 
 	// Links, URIs and images. FIXME: deal with ) in URI
-	re_g := regexp.MustCompile(`!\[(?P<text>[^\]]*)\](\((?P<path>[^\)]+)\))*(\{(?P<arguments>[^\}]*)\))*`) // graphics
 	// source: http://daringfireball.net/2010/07/improved_regex_for_matching_urls
 
 	re_uri := `(?i)\b((?:[a-z][\w-]+:(?:/{1,3}|[a-z0-9%])|www\d{0,3}[.]|[a-z0-9.\-]+[.][a-z]{2,4}/)(?:[^\s()<>]+|\(([^\s()<>]+|(\([^\s()<>]+\)))*\))+(?:\(([^\s()<>]+|(\([^\s()<>]+\)))*\)|[^\s!()\[\]{};:'",<>?«»“”‘’]))`
 
 	re_h := regexp.MustCompile(`\[(?P<text>[^\]]+)\]\((?P<uri>` + re_uri + `)\)`) // link
 
-	re_keyval := regexp.MustCompile(`(?P<key>\w+)\=(?P<value>[^,]+)`)
-	re_bogus := regexp.MustCompile(`align=center`)
 	found := false
 
 	// Scan line for Markdown markup
@@ -1757,64 +6953,8 @@ func process_md(line string) string {
 		found = true
 	}
 
-	// Process graphics links
-	if re_g.FindStringIndex(line) != nil {
-		// \\begin{center}\n  \\end{center}\n"
-		// FIXME: I need to remove invalid argument for includegraphics
-		md := map[string]string{}
-		n1 := re_g.SubexpNames()
-		r1 := re_g.FindAllStringSubmatch(line, -1)[0]
-		for i, n := range r1 {
-			if n1[i] == "arguments" && n != "" {
-				r2 := re_keyval.FindAllStringSubmatch(n, -1)
-				for _, pair := range r2 {
-					key := pair[1]
-					value := pair[2]
-					if key == "align" && value == "center" {
-						//info("Auto-centering")
-						//info("before: " + line)
-						line = re_bogus.ReplaceAllString(line, "")
-						//info("after: " + line)
-						pushEnv("center", "")
-					}
-
-				}
-			}
-			md[n1[i]] = n
-		}
-		line = re_g.ReplaceAllString(line, "\n\\includegraphics[$arguments]{$path}\n")
-		// FIXME: Dirty hack. Whatever the extension
-		// is, remove it and substitute PDF for
-		// TeX. But what if I really want to include a
-		// PNG?
-		line = regexp.MustCompile(`\.svg`).ReplaceAllString(line, ".pdf")
-		fmt.Println(line)
-		found = true
-	}
-
-	// No return value ?
-	processTables(line)
-	if regexp.MustCompile(`:*-{2,}\s+:*`).FindStringIndex(line) != nil {
-		debug("should be gone: " +line)
-		line = "%"
-	}
-
 	// Citations
-	re_p := regexp.MustCompile(`\[(?P<prefix>[^@]*)(?P<key>(@[^\[]+);*)+\s*(?P<suffix>[^\]]*)\]`) // Parenthesised citation
-	re_t := regexp.MustCompile(`@(?P<key>[\w\.]+)\s{0,1}(\[(?P<suffix>[^\}]+)\])*`)               //in-text citation
-	if re_p.FindStringIndex(line) != nil {
-		cites := parseCitations(line)
-		line = re_p.ReplaceAllString(line, "\\citep[$prefix][$suffix]{"+cites+"}")
-		o.hasCitations = true
-		found = true
-	} else {
-		if re_t.FindStringIndex(line) != nil {
-			cites := parseCitations(line)
-			line = re_t.ReplaceAllString(line, "\\citet[$suffix]{"+cites+"}")
-			o.hasCitations = true
-			found = true
-		}
-	}
+	line = citations(line, false)
 
 	if found {
 		if Debug > 0 {
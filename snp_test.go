@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestEscapeText(t *testing.T) {
+	envStack = make([]string, 7)
+	labels = map[string]Label{"sec:intro": {"sec", "1"}, "fig:cat": {"fig", "2"}}
+	tests := []struct {
+		in, want string
+	}{
+		{"50% & more", "50\\% \\& more"},
+		{"a_b #1 {x}", "a\\_b \\#1 \\{x\\}"},
+		{"café, naïve, 東京", "café, naïve, 東京"},
+		{"x^2^ and H~2~O", "x\\textsuperscript{2} and H\\textsubscript{2}O"},
+		{"a ^ b", "a \\textasciicircum{} b"},
+		{"a~b", "a\\textasciitilde{}b"},
+		{"~ alone", "\\textasciitilde{} alone"},
+		{"See @sec:intro.", "See Section~\\ref{sec:intro}."},
+		{"@sec:intro,@sec:intro", "Section~\\ref{sec:intro},Section~\\ref{sec:intro}"},
+		{"@sec:intro~@fig:cat", "Section~\\ref{sec:intro}\\textasciitilde{}\\hyperref[fig:cat]{Figure~2}"},
+		{"`a_b` and $a_b$", "\\texttt{a\\_b} and $a_b$"},
+		{"\\textbf{50%} off", "\\textbf{50\\%} off"},
+		{"a \\ b", "a \\textbackslash{} b"},
+		{"mail me@example.org", "mail me@example.org"},
+		{"{{Paris}} and {{\\frac{a}{b}}}", "\\cloze{Paris} and \\cloze{\\frac{a}{b}}"},
+		{"{{a \\{ b}} {{}}", "\\cloze{a \\{ b} \\{\\{\\}\\}"},
+	}
+	for _, tt := range tests {
+		if got := escapeText(tt.in); got != tt.want {
+			t.Errorf("escapeText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}